@@ -1,19 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	neturl "net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/sivanovie/appd-stats/pkg/appd/appdtest"
 	"github.com/sivanovie/appd-stats/pkg/conf"
 	report "github.com/sivanovie/appd-stats/pkg/excel"
 )
 
 func main() {
 
+	// FLAGS
+	demo := flag.Bool("demo", false, "generate a sample report (demo.xlsx) against a local mock Controller")
+	record := flag.String("record", "", "save all Controller requests/responses (secrets redacted) to this directory")
+	replay := flag.String("replay", "", "serve Controller responses recorded with --record from this directory instead of the network")
+	flag.Parse()
+
+	if *record != "" && *replay != "" {
+		fmt.Println("--record and --replay can't be used together.")
+		os.Exit(1)
+	}
+
 	// LOGGER
 	logname := "appd-stats.log"
 	_, err := conf.SetLogger(logname)
@@ -23,12 +42,42 @@ func main() {
 		os.Exit(1)
 	}
 
+	// DEMO
+	// Run against a local mock Controller instead of the controllers in conf.yaml
+	loadConf := conf.LoadConf
+	if *demo {
+		srv := appdtest.NewServer()
+		defer srv.Close()
+		loadConf = func() conf.Conf { return demoConf(srv) }
+	}
+
 	// CONF
-	conf := conf.LoadConf()
+	conf := loadConf()
+
+	// CANCELLATION
+	// Stop on SIGINT/SIGTERM or once the run timeout is reached, while still
+	// writing whatever has been collected so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Timeout)
+		defer cancel()
+	}
+
+	// Reports of all controllers, for the consolidated report
+	var reports []report.ControllerReport
 
 	// PER CONTROLLER
 	for i := range conf.Stats {
 
+		// Don't start on new controllers once interrupted
+		if ctx.Err() != nil {
+			log.Printf("Run interrupted (%v), skipping remaining controllers.", ctx.Err())
+			break
+		}
+
 		// VARS
 		controller := conf.Stats[i].Name
 		url := conf.Stats[i].Url
@@ -36,6 +85,13 @@ func main() {
 		secret := conf.Stats[i].Secret
 		account := conf.Stats[i].Account
 		auth := conf.Stats[i].Auth
+		proxy := conf.Stats[i].Proxy
+		tlsConf := conf.Stats[i].TLS
+		retry := conf.Stats[i].Retry
+		rateLimit := conf.Stats[i].RateLimit
+		concurrency := conf.Stats[i].Concurrency
+		batchSize := conf.Stats[i].BatchSize
+		agentPolicy := conf.Stats[i].Agents.MinVersion
 		reportName := conf.Stats[i].Report.Name
 		reportSubtitle := conf.Stats[i].Report.Subtitle
 		reportHeaderB2 := conf.Stats[i].Report.Header.B2
@@ -45,8 +101,43 @@ func main() {
 		scope := conf.Stats[i].Report.Scope
 		team := conf.Stats[i].Report.Team
 		description := conf.Stats[i].Report.Description
+		template := conf.Stats[i].Report.Template
+		chartTop := conf.Stats[i].Report.Charts.Top
+		thresholds := report.Thresholds{
+			ErrorRate: report.Threshold{
+				Warning:  conf.Stats[i].Report.Thresholds.ErrorRate.Warning,
+				Critical: conf.Stats[i].Report.Thresholds.ErrorRate.Critical,
+			},
+			ResponseTime: report.Threshold{
+				Warning:  conf.Stats[i].Report.Thresholds.ResponseTime.Warning,
+				Critical: conf.Stats[i].Report.Thresholds.ResponseTime.Critical,
+			},
+			NoHealthRules: strings.ToLower(conf.Stats[i].Report.Thresholds.NoHealthRules),
+		}
 		timerangePref := strings.ToLower(conf.Stats[i].Report.Timerange)
 
+		// Reject thresholds that can't be applied
+		if err := thresholds.Validate(); err != nil {
+			skipController(controller, fmt.Errorf("invalid thresholds: %w", err))
+			continue
+		}
+
+		// Custom metrics for every app
+		var customMetrics []appd.CustomMetric
+		for _, metric := range conf.Stats[i].Report.Metrics {
+			customMetrics = append(customMetrics, appd.CustomMetric{
+				Name:        metric.Name,
+				Path:        metric.Path,
+				Aggregation: strings.ToLower(metric.Value),
+				Series:      metric.Series,
+			})
+		}
+
+		// Columns of the main table (and CSV), the default ones unless selected
+		columns := selectColumns(controller, conf.Stats[i].Report.Columns)
+		writeCSV := conf.Stats[i].Report.CSV
+		healthRuleDetails := conf.Stats[i].Report.HealthRuleDetails == nil || *conf.Stats[i].Report.HealthRuleDetails
+
 		// Set time range
 
 		// end
@@ -88,59 +179,330 @@ func main() {
 
 		} else {
 
-			log.Printf("Unsupported timerange %v.", timerangePref)
-			break
+			skipController(controller, fmt.Errorf("unsupported timerange %q", timerangePref))
+			continue
+
+		}
 
+		// RECORD / REPLAY
+		// Traffic is kept in one sub directory per controller
+		var recordDir, replayDir string
+		if *record != "" {
+			recordDir = filepath.Join(*record, controller)
+		}
+		if *replay != "" {
+
+			replayDir = filepath.Join(*replay, controller)
+
+			// Ask for the recorded report window so requests match the recording
+			reportTimeStart, reportTimeEnd, err = loadTimeRange(replayDir)
+			if err != nil {
+				skipController(controller, err)
+				continue
+			}
+
+		}
+
+		// Make skipped certificate verification hard to miss
+		if tlsConf.InsecureSkipVerify {
+			fmt.Printf("\033[31mWARNING: TLS certificate verification is disabled for %v (insecureskipverify), don't use this in production.\033[0m\n", controller)
+		}
+
+		// CLIENT
+		ctrl, err := appd.NewController(appd.ControllerConfig{
+			Name:    controller,
+			URL:     url,
+			Client:  client,
+			Secret:  secret,
+			Account: account,
+			Auth:    auth,
+			Proxy:   proxy,
+			TLS: appd.TLSConfig{
+				CAFile:             tlsConf.CA,
+				CertFile:           tlsConf.Cert,
+				KeyFile:            tlsConf.Key,
+				MinVersion:         tlsConf.MinVersion,
+				InsecureSkipVerify: tlsConf.InsecureSkipVerify,
+			},
+			Retry: appd.RetryPolicy{
+				MaxAttempts: retry.Attempts,
+				BaseDelay:   retry.Backoff,
+				MaxDelay:    retry.MaxBackoff,
+			},
+			RequestsPerSecond: rateLimit,
+			Concurrency:       concurrency,
+			StatsBatchSize:    batchSize,
+			RecordDir:         recordDir,
+			ReplayDir:         replayDir,
+		})
+		if err != nil {
+			skipController(controller, err)
+			continue
+		}
+
+		// Keep the report window with the recording
+		if recordDir != "" {
+			if err := saveTimeRange(recordDir, reportTimeStart, reportTimeEnd); err != nil {
+				log.Printf("ERROR - Couldn't save report time range to %v: %v", recordDir, err)
+			}
 		}
 
 		// LOGIN
-		err, logincookies := appd.GetLoginCookies(url, auth)
+		_, err = ctrl.GetLoginCookies(ctx)
 		if err != nil {
-			log.Println("Couldn't login to Controller.")
+			skipController(controller, err)
+			continue
 		}
 
 		// TOKEN
 		log.Printf("Fetching temp token for %v.", controller)
 
-		err, token := appd.GetControllerAccessToken(client, account, secret, url)
+		_, err = ctrl.GetAccessToken(ctx)
 		if err != nil {
-			log.Println("Couldn't retrieve access token.")
+			skipController(controller, err)
+			continue
 		}
 
+		// Steps that failed, the report is marked incomplete if any
+		var failed []string
+
 		// ALL APPS
-		appsurl := url + "/controller/rest/applications?output=json"
-		apps, err := appd.GetEntitiesFromController(appsurl, token)
-		if err != nil {
+		apps, err := ctrl.GetApplications(ctx)
+		if errors.Is(err, appd.ErrAuthentication) {
+			skipController(controller, err)
+			continue
+		} else if err != nil {
 			log.Println("Couldn't get all apps for controller.")
+			failed = append(failed, "couldn't list applications")
 		}
 
 		// Get total number of calls and other summary stats
-		err, appsWithMetrics := appd.GetAllAppsSummaryStats(url, logincookies, apps, reportTimeStart, reportTimeEnd)
+		appsWithMetrics, err := ctrl.GetAllAppsSummaryStats(ctx, apps, reportTimeStart, reportTimeEnd)
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, "couldn't fetch application statistics")
+		}
+
+		appsWithMetricsAndHrs, err := ctrl.GetHealthRules(ctx, appsWithMetrics)
 		if err != nil {
 			log.Println(err)
+			failed = append(failed, err.Error())
 		}
 
-		err, appsWithMetricsAndHrs := appd.GetHealthRules(url, token, appsWithMetrics)
+		// Policies and actions of every app, to check health rules notify someone
+		appsWithMetricsAndHrs, err = ctrl.GetPolicies(ctx, appsWithMetricsAndHrs)
 		if err != nil {
 			log.Println(err)
+			failed = append(failed, err.Error())
 		}
 
-		err = report.BuildExcelReport(
-			appsWithMetricsAndHrs,
-			controller,
-			time.UnixMilli(reportTimeStart).Format(time.RFC3339),
-			time.UnixMilli(reportTimeEnd).Format(time.RFC3339),
-			reportName,
-			scope,
-			team,
-			description,
-			url,
-			reportHeaderB2,
-			reportHeaderB3,
-			reportHeaderB4,
-			reportHeaderB5,
-			reportSubtitle)
+		// Health rule details (one call per rule), to diff between runs
+		if healthRuleDetails {
+
+			appsWithMetricsAndHrs, err = ctrl.GetHealthRuleDetails(ctx, appsWithMetricsAndHrs)
+			if err != nil {
+				log.Println(err)
+				failed = append(failed, err.Error())
+			}
+
+			if err := appd.GenerateHealthRulesJSON(controller, appsWithMetricsAndHrs); err != nil {
+				log.Printf("ERROR - Couldn't write health rules JSON for %v: %v", controller, err)
+			}
+
+		}
+
+		// Health rule violations of every app in the report time range
+		appsWithMetricsAndHrs, err = ctrl.GetHealthRuleViolations(ctx, appsWithMetricsAndHrs, reportTimeStart, reportTimeEnd)
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, err.Error())
+		}
+
+		// Tiers and nodes of every app
+		appsWithMetricsAndHrs, err = ctrl.GetTiersAndNodes(ctx, appsWithMetricsAndHrs)
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, err.Error())
+		}
+
+		// Business transactions of every app, with their stats
+		appsWithMetricsAndHrs, err = ctrl.GetBusinessTransactions(ctx, appsWithMetricsAndHrs, reportTimeStart, reportTimeEnd)
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, err.Error())
+		}
+
+		// Backends called by every app, with their stats
+		appsWithMetricsAndHrs, err = ctrl.GetBackends(ctx, appsWithMetricsAndHrs, reportTimeStart, reportTimeEnd)
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, err.Error())
+		}
+
+		// Custom metrics of every app, if any
+		if len(customMetrics) > 0 {
+			appsWithMetricsAndHrs, err = ctrl.GetCustomMetrics(ctx, appsWithMetricsAndHrs, customMetrics, reportTimeStart, reportTimeEnd)
+			if err != nil {
+				log.Println(err)
+				failed = append(failed, err.Error())
+			}
+		}
 
+		// Calls and response time over the report window, for the Charts sheet
+		appsWithMetricsAndHrs, err = ctrl.GetPerformanceSeries(ctx, appsWithMetricsAndHrs, reportTimeStart, reportTimeEnd)
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, err.Error())
+		}
+
+		// Audit agent versions against the policy, if any
+		if len(agentPolicy) > 0 {
+
+			appsWithMetricsAndHrs, err = appd.CheckAgentCompliance(appsWithMetricsAndHrs, appd.AgentPolicy(agentPolicy))
+			if err != nil {
+				log.Printf("ERROR - Skipping agent compliance audit for %v: %v", controller, err)
+			} else if err := appd.GenerateAgentComplianceCSV(controller, appsWithMetricsAndHrs); err != nil {
+				log.Printf("ERROR - Couldn't write agent compliance CSV for %v: %v", controller, err)
+			}
+
+		}
+
+		// Mark the report incomplete if the run got interrupted or a step failed
+		incomplete := interrupted(ctx)
+		if incomplete == "" {
+			incomplete = strings.Join(failed, ", ")
+		}
+		if incomplete != "" {
+			log.Printf("WARN - Writing partial report for %v: %v.", controller, incomplete)
+		}
+
+		// Application table as CSV too
+		if writeCSV {
+			if err := appd.GenerateCSV(controller, appsWithMetricsAndHrs, columns); err != nil {
+				log.Printf("ERROR - Couldn't write CSV for %v: %v", controller, err)
+			}
+		}
+
+		// Default main table with the custom metrics
+		if len(columns) == 0 {
+			columns = appd.DefaultColumns(customMetrics)
+		}
+
+		info := report.ReportInfo{
+			Profile:           controller,
+			TimeRangeStart:    time.UnixMilli(reportTimeStart).Format(time.RFC3339),
+			TimeRangeEnd:      time.UnixMilli(reportTimeEnd).Format(time.RFC3339),
+			Name:              reportName,
+			Subtitle:          reportSubtitle,
+			Scope:             scope,
+			Team:              team,
+			Description:       description,
+			ControllerURL:     url,
+			B2:                reportHeaderB2,
+			B3:                reportHeaderB3,
+			B4:                reportHeaderB4,
+			B5:                reportHeaderB5,
+			Template:          template,
+			Columns:           columns,
+			CustomMetrics:     customMetricNames(customMetrics),
+			ChartTop:          chartTop,
+			Thresholds:        thresholds,
+			HealthRuleDetails: healthRuleDetails,
+			Incomplete:        incomplete,
+		}
+
+		err = report.BuildExcelReport(appsWithMetricsAndHrs, info)
+		if err != nil {
+			log.Printf("ERROR - Couldn't build report for %v: %v", controller, err)
+		}
+
+		// Kept for the consolidated report
+		reports = append(reports, report.ControllerReport{Info: info, Apps: appsWithMetricsAndHrs})
+
+	}
+
+	// CONSOLIDATED REPORT
+	// All controllers of the run in a single workbook
+	if conf.Consolidated.Name != "" && len(reports) > 0 {
+		if err := report.BuildConsolidatedReport(conf.Consolidated.Name, conf.Consolidated.Title, reports); err != nil {
+			log.Printf("ERROR - Couldn't build consolidated report: %v", err)
+		}
+	}
+
+}
+
+// interrupted explains why the run context is done, or returns "" if it isn't.
+func interrupted(ctx context.Context) string {
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return "run timeout reached before data collection finished"
+	case context.Canceled:
+		return "run cancelled before data collection finished"
 	}
 
+	return ""
+
+}
+
+// selectColumns returns the application table columns selected in the
+// configuration of a controller, with their custom headers and number
+// formats. Unknown columns are logged and left out.
+func selectColumns(controller string, selected []conf.ColumnConf) []appd.Column {
+
+	var columns []appd.Column
+
+	for _, c := range selected {
+
+		column, ok := appd.LookupColumn(c.Key)
+		if !ok {
+			log.Printf("ERROR - Unknown column %q for %v, use one of %v or %v<custom metric name>", c.Key, controller, strings.Join(appd.ColumnKeys(), ", "), appd.CustomMetricColumnPrefix)
+			continue
+		}
+
+		if c.Header != "" {
+			column.Header = c.Header
+		}
+		if c.Format != "" {
+			column.Format = c.Format
+		}
+
+		columns = append(columns, column)
+
+	}
+
+	return columns
+
+}
+
+// customMetricNames returns the names of the custom metrics, in order.
+func customMetricNames(metrics []appd.CustomMetric) []string {
+
+	var names []string
+	for _, metric := range metrics {
+		names = append(names, metric.Name)
+	}
+
+	return names
+
+}
+
+// skipController reports why a controller is left out of the run.
+func skipController(controller string, err error) {
+
+	var urlErr *neturl.Error
+
+	reason := "failed"
+	if errors.As(err, &urlErr) {
+		reason = "couldn't connect to Controller"
+	}
+	if errors.Is(err, appd.ErrAuthentication) {
+		reason = "authentication failed"
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		reason = "run interrupted"
+	}
+
+	log.Printf("ERROR - Skipping %v, %v: %v", controller, reason, err)
+	fmt.Printf("Skipping %v, %v: %v\n", controller, reason, err)
+
 }
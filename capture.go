@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// timeRangeFile holds the report window next to recorded Controller traffic,
+// so a replay asks for (and gets) exactly the same data.
+const timeRangeFile = "timerange.json"
+
+type timeRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// saveTimeRange writes the report window to the recording directory.
+func saveTimeRange(dir string, start int64, end int64) error {
+
+	data, err := json.MarshalIndent(timeRange{Start: start, End: end}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, timeRangeFile), data, 0644)
+
+}
+
+// loadTimeRange reads the report window from a recording directory.
+func loadTimeRange(dir string) (int64, int64, error) {
+
+	var window timeRange
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, timeRangeFile))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := json.Unmarshal(data, &window); err != nil {
+		return 0, 0, err
+	}
+
+	return window.Start, window.End, nil
+
+}
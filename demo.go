@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/sivanovie/appd-stats/pkg/appd/appdtest"
+	"github.com/sivanovie/appd-stats/pkg/conf"
+)
+
+// demoConf returns the configuration used by --demo: a single controller
+// profile pointing at the local mock Controller.
+func demoConf(srv *appdtest.Server) conf.Conf {
+
+	ctrl := conf.ControllerConf{
+		Name:    "demo",
+		Url:     srv.URL,
+		Client:  appdtest.Client,
+		Secret:  appdtest.Secret,
+		Account: appdtest.Account,
+		Auth:    appdtest.Auth,
+		Agents: conf.AgentsConf{
+			MinVersion: map[string]string{
+				"APP_AGENT":         "22.6.0",
+				"DOT_NET_APP_AGENT": "22.1.0",
+				"NODEJS_APP_AGENT":  "22.0.0",
+				"MACHINE_AGENT":     "23.1.0",
+			},
+		},
+		Report: conf.ReportConf{
+			Name:        "Demo Controller Report",
+			Subtitle:    "Generated against a mock Controller",
+			Timerange:   "last 1 month",
+			Scope:       "All APM applications",
+			Team:        "Demo Team",
+			Description: "Sample report showing the report layout",
+			Header: conf.HeaderConf{
+				B2: "AppD Quick Report",
+				B3: "Demo",
+				B4: "Mock Controller",
+				B5: srv.URL,
+			},
+			Thresholds: conf.ThresholdsConf{
+				ErrorRate:     conf.ThresholdConf{Warning: 0.5, Critical: 1},
+				ResponseTime:  conf.ThresholdConf{Warning: 300, Critical: 1000},
+				NoHealthRules: "critical",
+			},
+			Metrics: []conf.MetricConf{
+				{Name: "Avg Response Time (ms)", Path: "Overall Application Performance|Average Response Time (ms)", Value: "average"},
+				{Name: "Errors per Minute", Path: "Overall Application Performance|Errors per Minute", Value: "average", Series: true},
+			},
+		},
+	}
+
+	return conf.Conf{Stats: conf.StatsConf{ctrl}}
+
+}
@@ -0,0 +1,624 @@
+// Package appdtest provides a local mock AppDynamics Controller for tests
+// and demos. It serves the Controller endpoints used by pkg/appd from
+// fixture files and can inject failures (expired tokens, throttling,
+// server errors and malformed responses).
+package appdtest
+
+import (
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+)
+
+// Credentials accepted by the mock Controller.
+const (
+	Account = "customer1"
+	Client  = "apiclient"
+	Secret  = "secret"
+	User    = "user"
+	Pass    = "password"
+)
+
+// Auth is the base64 account@user:password accepted on login.
+var Auth = base64.StdEncoding.EncodeToString([]byte(Account + "@" + User + ":" + Pass))
+
+//go:embed fixtures
+var defaultFixtures embed.FS
+
+// Failure is an error the mock Controller can be told to return.
+type Failure int
+
+const (
+	// ExpiredToken answers 401 and invalidates all issued tokens and sessions
+	ExpiredToken Failure = iota + 1
+
+	// RateLimited answers 429 with Retry-After: 1
+	RateLimited
+
+	// ServerError answers 500
+	ServerError
+
+	// MalformedJSON answers 200 with a body that isn't valid JSON
+	MalformedJSON
+)
+
+// Server is a mock AppDynamics Controller backed by fixture files.
+type Server struct {
+	*httptest.Server
+
+	// TokenLifetime is the expires_in (seconds) returned with access tokens
+	TokenLifetime int
+
+	// MaxStatsBatch rejects statistics requests for more apps than this
+	// with 413, like a Controller with a capped request size. 0 means no cap
+	MaxStatsBatch int
+
+	mu       sync.Mutex
+	fixtures fs.FS
+	failures map[string][]Failure
+	requests map[string]int
+	tokens   map[string]bool
+	sessions map[string]bool
+	issued   int
+}
+
+// NewServer starts a mock Controller serving the built-in demo fixtures.
+func NewServer() *Server {
+
+	fixtures, _ := fs.Sub(defaultFixtures, "fixtures")
+
+	return NewServerWithFixtures(fixtures)
+
+}
+
+// NewServerWithFixtures starts a mock Controller serving the given fixtures.
+// See the fixtures directory of this package for the expected layout.
+func NewServerWithFixtures(fixtures fs.FS) *Server {
+
+	s := &Server{
+		TokenLifetime: 300,
+		fixtures:      fixtures,
+		failures:      map[string][]Failure{},
+		requests:      map[string]int{},
+		tokens:        map[string]bool{},
+		sessions:      map[string]bool{},
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+
+}
+
+// Config returns a Controller configuration pointing at the mock server
+// with valid credentials.
+func (s *Server) Config() appd.ControllerConfig {
+	return appd.ControllerConfig{
+		Name:    "mock",
+		URL:     s.URL,
+		Client:  Client,
+		Secret:  Secret,
+		Account: Account,
+		Auth:    Auth,
+	}
+}
+
+// Fail queues failures for the next requests whose path starts with prefix.
+// Each queued failure is used once, in order.
+func (s *Server) Fail(prefix string, failures ...Failure) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[prefix] = append(s.failures[prefix], failures...)
+
+}
+
+// ExpireCredentials invalidates all issued access tokens and login sessions.
+func (s *Server) ExpireCredentials() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = map[string]bool{}
+	s.sessions = map[string]bool{}
+
+}
+
+// Requests returns how many requests were received for the given path.
+func (s *Server) Requests(path string) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[path]
+
+}
+
+// nextFailure pops the first queued failure matching the path.
+func (s *Server) nextFailure(path string) Failure {
+
+	for prefix, queue := range s.failures {
+
+		if strings.HasPrefix(path, prefix) && len(queue) > 0 {
+			s.failures[prefix] = queue[1:]
+			return queue[0]
+		}
+
+	}
+
+	return 0
+
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	failure := s.nextFailure(r.URL.Path)
+	s.mu.Unlock()
+
+	// Injected failures
+	switch failure {
+	case ExpiredToken:
+		s.ExpireCredentials()
+		http.Error(w, "token expired", http.StatusUnauthorized)
+		return
+	case RateLimited:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	case ServerError:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	case MalformedJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": [ {"id": 1, "name": `))
+		return
+	}
+
+	switch {
+
+	case r.URL.Path == "/api/oauth/access_token":
+		s.handleAccessToken(w, r)
+
+	case r.URL.Path == "/auth":
+		s.handleLogin(w, r)
+
+	case strings.HasPrefix(r.URL.Path, "/controller/restui/"):
+		if !s.validSession(r) {
+			http.Error(w, "invalid session", http.StatusUnauthorized)
+			return
+		}
+		s.handleRestui(w, r)
+
+	case strings.HasPrefix(r.URL.Path, "/controller/"):
+		if !s.validToken(r) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		s.handleRest(w, r)
+
+	default:
+		http.NotFound(w, r)
+
+	}
+
+}
+
+func (s *Server) handleAccessToken(w http.ResponseWriter, r *http.Request) {
+
+	// The Controller expects the form with a protobuf content type, so
+	// parse the body by hand
+	body, _ := ioutil.ReadAll(r.Body)
+	form, _ := url.ParseQuery(string(body))
+
+	if r.Method != "POST" || form.Get("client_id") != Client+"@"+Account || form.Get("client_secret") != Secret {
+		http.Error(w, "invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	s.issued++
+	token := fmt.Sprintf("mock-token-%v-%v", s.issued, strings.Repeat("x", 120))
+	s.tokens[token] = true
+	lifetime := s.TokenLifetime
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"access_token": token,
+		"expires_in":   lifetime,
+	})
+
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Query().Get("action") != "login" || r.Header.Get("Authorization") != "Basic "+Auth {
+		http.Error(w, "invalid user credentials", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	s.issued++
+	session := fmt.Sprintf("mock-session-%v", s.issued)
+	s.sessions[session] = true
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: session})
+	http.SetCookie(w, &http.Cookie{Name: "X-CSRF-TOKEN", Value: session})
+
+}
+
+func (s *Server) validToken(r *http.Request) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+
+}
+
+func (s *Server) validSession(r *http.Request) bool {
+
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil || r.Header.Get("X-CSRF-TOKEN") != cookie.Value {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions[cookie.Value]
+
+}
+
+// handleRestui serves the application statistics, filtered by requestFilter.
+func (s *Server) handleRestui(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/controller/restui/v1/app/list/ids" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var payload appd.AppStatisticsPayload
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.MaxStatsBatch > 0 && len(payload.RequestFilter) > s.MaxStatsBatch {
+		http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var stats struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if !s.readFixture(w, "app-stats.json", &stats) {
+		return
+	}
+
+	// Keep the requested apps only
+	wanted := map[int64]bool{}
+	for _, id := range payload.RequestFilter {
+		wanted[id] = true
+	}
+
+	filtered := []map[string]interface{}{}
+	for _, row := range stats.Data {
+		if id, ok := row["id"].(float64); ok && wanted[int64(id)] {
+			filtered = append(filtered, row)
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{"data": filtered})
+
+}
+
+// handleRest serves the REST and alerting API from fixtures.
+func (s *Server) handleRest(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+
+	// /controller/rest/applications
+	case r.URL.Path == "/controller/rest/applications":
+		s.serveFixture(w, "applications.json", "[]")
+
+	// /controller/rest/applications/{id}/tiers, /nodes, /business-transactions and /backends
+	case len(parts) == 5 && parts[1] == "rest" && (parts[4] == "tiers" || parts[4] == "nodes" || parts[4] == "business-transactions" || parts[4] == "backends"):
+		if _, err := strconv.Atoi(parts[3]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveFixture(w, path.Join(parts[4], parts[3]+".json"), "[]")
+
+	// /controller/rest/applications/{id}/metric-data
+	case len(parts) == 5 && parts[1] == "rest" && parts[4] == "metric-data":
+		if _, err := strconv.Atoi(parts[3]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.handleMetricData(w, r, parts[3])
+
+	// /controller/rest/applications/{id}/problems/healthrule-violations
+	case len(parts) == 6 && parts[1] == "rest" && parts[4] == "problems" && parts[5] == "healthrule-violations":
+		if _, err := strconv.Atoi(parts[3]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.handleViolations(w, r, parts[3])
+
+	// /controller/alerting/rest/v1/applications/{id}/actions
+	case len(parts) == 7 && parts[1] == "alerting" && parts[6] == "actions":
+		if _, err := strconv.Atoi(parts[5]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveFixture(w, path.Join("actions", parts[5]+".json"), "[]")
+
+	// /controller/alerting/rest/v1/applications/{id}/policies[/{policy}]
+	case (len(parts) == 7 || len(parts) == 8) && parts[1] == "alerting" && parts[6] == "policies":
+		if _, err := strconv.Atoi(parts[5]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		policy := ""
+		if len(parts) == 8 {
+			policy = parts[7]
+		}
+		s.handlePolicies(w, r, parts[5], policy)
+
+	// /controller/alerting/rest/v1/applications/{id}/health-rules
+	case len(parts) == 7 && parts[1] == "alerting" && parts[6] == "health-rules":
+		if _, err := strconv.Atoi(parts[5]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveFixture(w, path.Join("health-rules", parts[5]+".json"), "[]")
+
+	// /controller/alerting/rest/v1/applications/{id}/health-rules/{rule}
+	case len(parts) == 8 && parts[1] == "alerting" && parts[6] == "health-rules":
+		_, appErr := strconv.Atoi(parts[5])
+		_, ruleErr := strconv.Atoi(parts[7])
+		if appErr != nil || ruleErr != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := fs.Stat(s.fixtures, path.Join("health-rules", parts[5], parts[7]+".json")); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveFixture(w, path.Join("health-rules", parts[5], parts[7]+".json"), "{}")
+
+	default:
+		http.NotFound(w, r)
+
+	}
+
+}
+
+// handlePolicies serves the policy list of an app, or the details of one
+// policy. The fixture holds the policy details.
+func (s *Server) handlePolicies(w http.ResponseWriter, r *http.Request, app string, policy string) {
+
+	policies := []map[string]interface{}{}
+	if _, err := fs.Stat(s.fixtures, path.Join("policies", app+".json")); err == nil {
+		if !s.readFixture(w, path.Join("policies", app+".json"), &policies) {
+			return
+		}
+	}
+
+	// Policy list
+	if policy == "" {
+
+		summaries := []map[string]interface{}{}
+		for _, p := range policies {
+			summaries = append(summaries, map[string]interface{}{"id": p["id"], "name": p["name"], "enabled": p["enabled"]})
+		}
+		writeJSON(w, summaries)
+
+		return
+
+	}
+
+	// Policy details
+	for _, p := range policies {
+		if fmt.Sprint(p["id"]) == policy {
+			writeJSON(w, p)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+
+}
+
+// handleViolations serves the health rule violations of an app. Negative
+// start and end times in the fixture are relative to the end of the
+// requested time range, so the demo always has recent violations.
+func (s *Server) handleViolations(w http.ResponseWriter, r *http.Request, app string) {
+
+	violations := []map[string]interface{}{}
+	if _, err := fs.Stat(s.fixtures, path.Join("violations", app+".json")); err == nil {
+		if !s.readFixture(w, path.Join("violations", app+".json"), &violations) {
+			return
+		}
+	}
+
+	end, err := strconv.ParseFloat(r.URL.Query().Get("end-time"), 64)
+	if err != nil {
+		http.Error(w, "invalid end-time", http.StatusBadRequest)
+		return
+	}
+
+	for _, violation := range violations {
+		for _, key := range []string{"startTimeInMillis", "detectedTimeInMillis", "endTimeInMillis"} {
+			if t, ok := violation[key].(float64); ok && t < 0 {
+				violation[key] = end + t
+			}
+		}
+	}
+
+	writeJSON(w, violations)
+
+}
+
+// handleMetricData serves the metrics of an app matching metric-path, where
+// any segment may be a * wildcard. Unless rollup=false, the data points of
+// each metric are rolled up into one. Negative point times in the fixture
+// are relative to the end of the requested time range.
+func (s *Server) handleMetricData(w http.ResponseWriter, r *http.Request, app string) {
+
+	var metrics []map[string]interface{}
+	if _, err := fs.Stat(s.fixtures, path.Join("metric-data", app+".json")); err == nil {
+		if !s.readFixture(w, path.Join("metric-data", app+".json"), &metrics) {
+			return
+		}
+	}
+
+	pattern := strings.Split(r.URL.Query().Get("metric-path"), "|")
+	rollup := r.URL.Query().Get("rollup") != "false"
+	end, _ := strconv.ParseFloat(r.URL.Query().Get("end-time"), 64)
+
+	matched := []map[string]interface{}{}
+	for _, metric := range metrics {
+
+		metricPath, _ := metric["metricPath"].(string)
+		if !matchMetricPath(pattern, strings.Split(metricPath, "|")) {
+			continue
+		}
+
+		values, _ := metric["metricValues"].([]interface{})
+		for _, v := range values {
+			point, _ := v.(map[string]interface{})
+			if t, ok := point["startTimeInMillis"].(float64); ok && t < 0 {
+				point["startTimeInMillis"] = end + t
+			}
+		}
+
+		if rollup {
+			metric["metricValues"] = rollupMetricValues(values)
+		}
+
+		matched = append(matched, metric)
+
+	}
+
+	writeJSON(w, matched)
+
+}
+
+// matchMetricPath tells if a metric path matches a pattern, segment by segment.
+func matchMetricPath(pattern []string, segments []string) bool {
+
+	if len(pattern) != len(segments) {
+		return false
+	}
+
+	for i := range pattern {
+		if pattern[i] != "*" && pattern[i] != segments[i] {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// rollupMetricValues merges data points like the Controller does with rollup:
+// counts and sums are added up, values are averaged.
+func rollupMetricValues(values []interface{}) []interface{} {
+
+	if len(values) == 0 {
+		return values
+	}
+
+	rolled := map[string]float64{}
+	var minimum, maximum float64
+	for i, v := range values {
+
+		point, _ := v.(map[string]interface{})
+		num := func(key string) float64 { n, _ := point[key].(float64); return n }
+
+		if i == 0 || num("min") < minimum {
+			minimum = num("min")
+		}
+		if i == 0 || num("max") > maximum {
+			maximum = num("max")
+		}
+		rolled["occurrences"] += num("occurrences")
+		rolled["count"] += num("count")
+		rolled["sum"] += num("sum")
+		rolled["value"] += num("value") / float64(len(values))
+		rolled["current"] = num("current")
+
+	}
+
+	first, _ := values[0].(map[string]interface{})
+
+	return []interface{}{map[string]interface{}{
+		"startTimeInMillis": first["startTimeInMillis"],
+		"occurrences":       rolled["occurrences"],
+		"current":           rolled["current"],
+		"min":               minimum,
+		"max":               maximum,
+		"useRange":          true,
+		"count":             rolled["count"],
+		"sum":               rolled["sum"],
+		"value":             math.Round(rolled["value"]),
+	}}
+
+}
+
+// serveFixture writes a fixture file, or fallback if it doesn't exist.
+func (s *Server) serveFixture(w http.ResponseWriter, name string, fallback string) {
+
+	body, err := fs.ReadFile(s.fixtures, name)
+	if err != nil {
+		body = []byte(fallback)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+
+}
+
+// readFixture decodes a fixture file into v, answering 500 on failure.
+func (s *Server) readFixture(w http.ResponseWriter, name string, v interface{}) bool {
+
+	body, err := fs.ReadFile(s.fixtures, name)
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+
+}
@@ -0,0 +1,232 @@
+package appd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// backendMetrics is the metric path of all the backend metrics of an
+// application: backend|metric.
+const backendMetrics = "Backends|*|*"
+
+// backendMetricPrefix is how backends are named in metric paths.
+const backendMetricPrefix = "Discovered backend call - "
+
+type AppBackend struct {
+	Name          string
+	Id            int64
+	ExitPointType string
+
+	// Tier the backend resolves to (0 and "" when unresolved). TierName
+	// includes the application when the tier belongs to another app
+	TierId   int64
+	TierName string
+
+	Metrics BackendMetrics
+}
+type BackendMetrics struct {
+	NumberOfCalls       int64
+	NumberOfErrors      int64
+	AverageResponseTime float64
+}
+
+// SharedBackend is a backend called by more than one application.
+type SharedBackend struct {
+	Name           string
+	ExitPointType  string
+	Applications   []string
+	NumberOfCalls  int64
+	NumberOfErrors int64
+}
+
+// GetBackends fetches the backends (remote services) called by every given
+// application in parallel, with their statistics for the given time range.
+// Backends resolving to a tier get the tier name from the tiers already
+// fetched with GetTiersAndNodes. Applications whose backends couldn't be
+// fetched get the failure recorded in Failures.
+func (c *Controller) GetBackends(ctx context.Context, appsinfo []AppDetails, startTime int64, endTime int64) ([]AppDetails, error) {
+
+	err := c.forEachApp(ctx, appsinfo, FetchBackends, func(ctx context.Context, app *AppDetails) error {
+		return c.getAppBackends(ctx, app, startTime, endTime)
+	})
+
+	// Tier names by tier ID, across all apps since backends may resolve to
+	// another app
+	tiers := map[int64]string{}
+	for i := range appsinfo {
+		for _, tier := range appsinfo[i].Tiers {
+			tiers[tier.Id] = appsinfo[i].Name + " / " + tier.Name
+		}
+	}
+
+	for i := range appsinfo {
+
+		// Tier names within the app itself don't need the app name
+		own := map[int64]string{}
+		for _, tier := range appsinfo[i].Tiers {
+			own[tier.Id] = tier.Name
+		}
+
+		for ii := range appsinfo[i].Backends {
+
+			backend := &appsinfo[i].Backends[ii]
+			if backend.TierId == 0 {
+				continue
+			}
+
+			if name, ok := own[backend.TierId]; ok {
+				backend.TierName = name
+			} else if name, ok := tiers[backend.TierId]; ok {
+				backend.TierName = name
+			} else {
+				backend.TierName = fmt.Sprintf("tier %v", backend.TierId)
+			}
+
+		}
+
+	}
+
+	return appsinfo, err
+
+}
+
+// getAppBackends fetches the backends of a single application, then their
+// metrics in a single metric-data call.
+func (c *Controller) getAppBackends(ctx context.Context, app *AppDetails, startTime int64, endTime int64) error {
+
+	var backends []AppBackend
+
+	// Backends
+	beurl := "/controller/rest/applications/" + fmt.Sprint(app.Id) + "/backends?output=json"
+
+	err := c.stream(ctx, authToken, "GET", beurl, nil, func(dec *json.Decoder) error {
+
+		var backend backendResponse
+		if err := dec.Decode(&backend); err != nil {
+			return err
+		}
+
+		backends = append(backends, AppBackend{
+			Name:          backend.Name,
+			Id:            backend.Id,
+			ExitPointType: backend.ExitPointType,
+			TierId:        backend.TierId,
+		})
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	// Nothing to get metrics for
+	if len(backends) == 0 {
+		app.Backends = backends
+		return nil
+	}
+
+	// Index backends by name, as found in metric paths
+	byName := make(map[string]int, len(backends))
+	for i := range backends {
+		byName[backends[i].Name] = i
+	}
+
+	// All the backend metrics, rolled up over the time range
+	metrics, err := c.GetMetricData(ctx, app.Id, backendMetrics, startTime, endTime, true)
+	if err != nil {
+		return err
+	}
+
+	for _, metric := range metrics {
+
+		// Backends|Discovered backend call - name|metric
+		parts := strings.Split(metric.Path, "|")
+		if len(parts) < 3 {
+			continue
+		}
+
+		// Backend names may contain |
+		name := strings.TrimPrefix(strings.Join(parts[1:len(parts)-1], "|"), backendMetricPrefix)
+		i, ok := byName[name]
+		if !ok {
+			log.Printf("WARN - Got metric %v for unknown backend of application %v.", metric.Path, app.Name)
+			continue
+		}
+
+		sum, value := metric.Sum(), metric.Average()
+		m := &backends[i].Metrics
+
+		switch parts[len(parts)-1] {
+		case "Calls per Minute":
+			m.NumberOfCalls = sum
+		case "Errors per Minute":
+			m.NumberOfErrors = sum
+		case "Average Response Time (ms)":
+			m.AverageResponseTime = value
+		}
+
+	}
+
+	// Busiest first
+	sort.SliceStable(backends, func(i, j int) bool {
+		return backends[i].Metrics.NumberOfCalls > backends[j].Metrics.NumberOfCalls
+	})
+
+	app.Backends = backends
+
+	return nil
+
+}
+
+// SharedBackends returns the backends called by more than one of the given
+// applications, matched by exit point type and name. They are sorted by
+// number of applications, then by name.
+func SharedBackends(appsinfo []AppDetails) []SharedBackend {
+
+	var shared []SharedBackend
+	byKey := map[string]int{}
+
+	for _, app := range appsinfo {
+
+		for _, backend := range app.Backends {
+
+			key := backend.ExitPointType + "|" + backend.Name
+
+			i, ok := byKey[key]
+			if !ok {
+				i = len(shared)
+				byKey[key] = i
+				shared = append(shared, SharedBackend{Name: backend.Name, ExitPointType: backend.ExitPointType})
+			}
+
+			shared[i].Applications = append(shared[i].Applications, app.Name)
+			shared[i].NumberOfCalls += backend.Metrics.NumberOfCalls
+			shared[i].NumberOfErrors += backend.Metrics.NumberOfErrors
+
+		}
+
+	}
+
+	// Keep the backends of more than one app
+	kept := shared[:0]
+	for _, backend := range shared {
+		if len(backend.Applications) > 1 {
+			kept = append(kept, backend)
+		}
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool {
+		if len(kept[i].Applications) != len(kept[j].Applications) {
+			return len(kept[i].Applications) > len(kept[j].Applications)
+		}
+		return kept[i].Name < kept[j].Name
+	})
+
+	return kept
+
+}
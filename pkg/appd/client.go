@@ -0,0 +1,479 @@
+package appd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshMargin is how long before its expiry the access token is refreshed.
+const tokenRefreshMargin = 30 * time.Second
+
+// defaultTokenLifetime is used when the Controller doesn't return expires_in.
+// Access tokens are valid for 5 minutes by default.
+const defaultTokenLifetime = 5 * time.Minute
+
+// defaultStatsBatchSize is the number of application IDs sent per summary
+// statistics request when none is configured.
+const defaultStatsBatchSize = 100
+
+// ControllerConfig holds the connection details and credentials
+// needed to talk to a single AppDynamics Controller.
+type ControllerConfig struct {
+	Name    string
+	URL     string
+	Client  string
+	Secret  string
+	Account string
+	Auth    string
+	Timeout time.Duration
+
+	// Proxy URL, defaults to HTTPS_PROXY/HTTP_PROXY from the environment
+	Proxy string
+
+	// TLS settings: extra CAs, client certificate, minimum version
+	TLS TLSConfig
+
+	// Retry policy for transient failures (DefaultRetryPolicy for unset fields)
+	Retry RetryPolicy
+
+	// Maximum number of requests per second sent to the Controller (0 = unlimited)
+	RequestsPerSecond float64
+
+	// Number of applications fetched in parallel for per-app calls
+	Concurrency int
+
+	// Number of application IDs per summary statistics request
+	StatsBatchSize int
+
+	// Save every request/response pair (redacted) to this directory
+	RecordDir string
+
+	// Serve responses recorded in this directory instead of calling the Controller
+	ReplayDir string
+}
+
+// Controller is a reusable client for a single AppDynamics Controller.
+// It shares one HTTP transport across all API calls and keeps the OAuth
+// access token and the session cookies obtained on login, refreshing them
+// when they expire or get rejected by the Controller.
+type Controller struct {
+	ControllerConfig
+
+	httpClient *http.Client
+	limiter    *RateLimiter
+
+	// authMu guards the credentials below
+	authMu      sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	tokenGen    int
+	cookies     []*http.Cookie
+	sessionGen  int
+}
+
+// authScheme tells how a request to the Controller is authorised.
+type authScheme int
+
+const (
+	// authToken authorises with the OAuth access token (REST API)
+	authToken authScheme = iota
+
+	// authSession authorises with the login cookies (restui)
+	authSession
+)
+
+// NewController returns a Controller client for the given configuration.
+func NewController(conf ControllerConfig) (*Controller, error) {
+
+	// Default timeout
+	if conf.Timeout == 0 {
+		conf.Timeout = 60 * time.Second
+	}
+
+	// Default retry policy
+	if conf.Retry.MaxAttempts <= 0 {
+		conf.Retry.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if conf.Retry.BaseDelay <= 0 {
+		conf.Retry.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if conf.Retry.MaxDelay <= 0 {
+		conf.Retry.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+
+	// Default number of workers for per-app calls
+	if conf.Concurrency <= 0 {
+		conf.Concurrency = defaultConcurrency
+	}
+
+	// Default batch size for summary statistics
+	if conf.StatsBatchSize <= 0 {
+		conf.StatsBatchSize = defaultStatsBatchSize
+	}
+
+	// Strip trailing slash so paths can be appended safely
+	conf.URL = strings.TrimRight(conf.URL, "/")
+
+	// Transport shared by all calls
+	base, err := newTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = base
+
+	// Replay recorded traffic, or record it
+	if conf.ReplayDir != "" {
+
+		replay, err := newReplayTransport(conf.ReplayDir)
+		if err != nil {
+			return nil, err
+		}
+		transport = replay
+
+		log.Printf("Replaying Controller traffic for %v from %v.", conf.Name, conf.ReplayDir)
+
+	} else if conf.RecordDir != "" {
+
+		record, err := newRecordingTransport(conf.RecordDir, transport)
+		if err != nil {
+			return nil, err
+		}
+		transport = record
+
+		log.Printf("Recording Controller traffic for %v to %v.", conf.Name, conf.RecordDir)
+
+	}
+
+	return &Controller{
+		ControllerConfig: conf,
+		httpClient: &http.Client{
+			Timeout:   conf.Timeout,
+			Transport: transport,
+		},
+		limiter: NewRateLimiter(conf.RequestsPerSecond),
+	}, nil
+
+}
+
+// Token returns the current OAuth access token.
+func (c *Controller) Token() string {
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	return c.token
+
+}
+
+// Cookies returns the current session cookies (JSESSIONID and X-CSRF-TOKEN).
+func (c *Controller) Cookies() []*http.Cookie {
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	return c.cookies
+
+}
+
+// accessToken returns a valid access token, refreshing it first if it is
+// missing or about to expire.
+func (c *Controller) accessToken(ctx context.Context) (string, int, error) {
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if c.token == "" || time.Now().Add(tokenRefreshMargin).After(c.tokenExpiry) {
+
+		log.Printf("Access token for %v is missing or about to expire, refreshing.", c.Name)
+
+		if _, err := c.requestAccessToken(ctx); err != nil {
+			return "", c.tokenGen, err
+		}
+
+	}
+
+	return c.token, c.tokenGen, nil
+
+}
+
+// session returns the login cookies, logging in first if there are none.
+func (c *Controller) session(ctx context.Context) ([]*http.Cookie, int, error) {
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if len(c.cookies) == 0 {
+
+		log.Printf("No login session for %v, logging in.", c.Name)
+
+		if _, err := c.requestLoginCookies(ctx); err != nil {
+			return nil, c.sessionGen, err
+		}
+
+	}
+
+	return c.cookies, c.sessionGen, nil
+
+}
+
+// reauthenticate renews the credentials used by the given scheme, unless
+// another caller already renewed them since generation gen was handed out.
+func (c *Controller) reauthenticate(ctx context.Context, scheme authScheme, gen int) error {
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if scheme == authToken {
+
+		if gen != c.tokenGen {
+			return nil
+		}
+
+		_, err := c.requestAccessToken(ctx)
+		return err
+
+	}
+
+	if gen != c.sessionGen {
+		return nil
+	}
+
+	_, err := c.requestLoginCookies(ctx)
+	return err
+
+}
+
+// newRequest creates a request against the Controller authorised with the
+// given scheme. It also returns the generation of the credentials used.
+func (c *Controller) newRequest(ctx context.Context, scheme authScheme, method string, path string, payload []byte) (*http.Request, int, error) {
+
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	// Create a new HTTP request object
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if scheme == authToken {
+
+		token, gen, err := c.accessToken(ctx)
+		if err != nil {
+			return nil, gen, err
+		}
+
+		// Set HTTP headers
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		return req, gen, nil
+
+	}
+
+	cookies, gen, err := c.session(ctx)
+	if err != nil {
+		return nil, gen, err
+	}
+
+	// Add the login cookies and headers to request
+	for i := range cookies {
+
+		// Add the login cookies to request
+		req.AddCookie(cookies[i])
+
+		// Add the X-CSRF-TOKEN as a request header
+		if cookies[i].Name == "X-CSRF-TOKEN" {
+			req.Header.Add(cookies[i].Name, cookies[i].Value)
+		}
+
+	}
+
+	// More headers
+	req.Header.Add("Content-Type", "application/json;charset=UTF-8")
+	req.Header.Add("Accept", "application/json, text/plain, */*")
+
+	return req, gen, nil
+
+}
+
+// call sends a request to the Controller and returns the response body.
+func (c *Controller) call(ctx context.Context, scheme authScheme, method string, path string, payload []byte) ([]byte, error) {
+
+	res, err := c.open(ctx, scheme, method, path, payload, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the body stream to avoid leaks later
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+
+}
+
+// stream sends a request to the Controller and decodes the JSON array in the
+// response one element at a time with each, without holding the whole
+// response in memory.
+func (c *Controller) stream(ctx context.Context, scheme authScheme, method string, path string, payload []byte, each func(dec *json.Decoder) error) error {
+
+	res, err := c.open(ctx, scheme, method, path, payload, false)
+	if err != nil {
+		return err
+	}
+
+	// Close the body stream to avoid leaks later
+	defer res.Body.Close()
+
+	return decodeJSONArray(c.URL+path, res.Body, each)
+
+}
+
+// open sends a request to the Controller and returns the response with its
+// body still to be read. Any HTTP state other than 200 is returned as an
+// HTTPStatusError, or as a RateLimitedError when the Controller kept
+// throttling us. When the Controller rejects the credentials (HTTP 401/403)
+// the client re-authenticates and retries the request once; if they are
+// rejected again an AuthError is returned.
+func (c *Controller) open(ctx context.Context, scheme authScheme, method string, path string, payload []byte, buffered bool) (*http.Response, error) {
+
+	for attempt := 1; ; attempt++ {
+
+		// Create a new HTTP request object
+		req, gen, err := c.newRequest(ctx, scheme, method, path, payload)
+		if err != nil {
+			log.Printf("ERROR - %v", err)
+			return nil, err
+		}
+
+		// Make the HTTP request to the Controller
+		res, err := c.send(req, buffered)
+		if err != nil {
+			log.Printf("ERROR - %v", err)
+			return nil, err
+		}
+
+		// All good, the caller reads the body
+		if res.StatusCode == 200 {
+			return res, nil
+		}
+
+		// If HTTP state from controller is bad we quit
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		log.Printf("ERROR - Got HTTP state %v while calling %v. %v", res.StatusCode, req.URL, string(body))
+
+		statusErr := newHTTPStatusError(req, res, body)
+
+		switch {
+
+		// Throttled even after retries
+		case res.StatusCode == http.StatusTooManyRequests:
+			return nil, &RateLimitedError{URL: req.URL.String(), RetryAfter: retryAfter(res), Err: statusErr}
+
+		// Credentials rejected again after renewing them, give up
+		case (res.StatusCode == 401 || res.StatusCode == 403) && attempt > 1:
+			return nil, &AuthError{Op: "request", URL: req.URL.String(), Err: statusErr}
+
+		// Credentials rejected, renew them and try once more
+		case res.StatusCode == 401 || res.StatusCode == 403:
+
+			log.Printf("WARN - Got HTTP state %v while calling %v, re-authenticating and retrying.", res.StatusCode, req.URL)
+
+			if err := c.reauthenticate(ctx, scheme, gen); err != nil {
+				return nil, err
+			}
+
+			continue
+
+		}
+
+		return nil, statusErr
+
+	}
+
+}
+
+// send makes the HTTP request through the rate limiter and retries it on
+// transient failures according to the retry policy. With buffered set the
+// whole response body is read before returning, so a connection dropped
+// halfway through the body is retried too. Cancelling the request context
+// stops both the in-flight request and any pending retry. The caller must
+// close the response body.
+func (c *Controller) send(req *http.Request, buffered bool) (*http.Response, error) {
+
+	ctx := req.Context()
+
+	for attempt := 1; ; attempt++ {
+
+		// Wait for our turn
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		// Make the HTTP request to the Controller
+		res, err := c.httpClient.Do(req)
+
+		// Read the body into memory
+		if err == nil && buffered {
+			var body []byte
+			body, err = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		// Give up if cancelled, if this isn't a transient failure or if we are out of attempts
+		if ctx.Err() != nil || attempt >= c.Retry.MaxAttempts || !retryable(res, err) {
+			if err != nil && res != nil {
+				res.Body.Close()
+				return nil, err
+			}
+			return res, err
+		}
+
+		// Drop this response before trying again
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		// Back off, unless the Controller told us how long to wait
+		delay := retryAfter(res)
+		if delay <= 0 {
+			delay = c.Retry.backoff(attempt)
+		}
+
+		if err != nil {
+			log.Printf("WARN - Calling %v failed (%v), retrying in %v (attempt %v of %v).", req.URL, err, delay, attempt+1, c.Retry.MaxAttempts)
+		} else {
+			log.Printf("WARN - Got HTTP state %v while calling %v, retrying in %v (attempt %v of %v).", res.StatusCode, req.URL, delay, attempt+1, c.Retry.MaxAttempts)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// Rewind the request body for the next attempt
+		next := req.Clone(ctx)
+		if req.GetBody != nil {
+			if next.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = next
+
+	}
+
+}
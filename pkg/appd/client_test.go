@@ -0,0 +1,405 @@
+package appd_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/sivanovie/appd-stats/pkg/appd/appdtest"
+)
+
+const applicationsPath = "/controller/rest/applications"
+
+// newController starts a mock Controller and a client for it, retrying
+// without noticeable delays.
+func newController(t *testing.T) (*appdtest.Server, *appd.Controller) {
+
+	t.Helper()
+
+	server := appdtest.NewServer()
+	t.Cleanup(server.Close)
+
+	conf := server.Config()
+	conf.Retry = appd.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	ctrl, err := appd.NewController(conf)
+	if err != nil {
+		t.Fatalf("NewController: %v", err)
+	}
+
+	return server, ctrl
+
+}
+
+func TestExpiredTokenReauthenticates(t *testing.T) {
+
+	server, ctrl := newController(t)
+	ctx := context.Background()
+
+	if _, err := ctrl.GetAccessToken(ctx); err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+
+	server.Fail(applicationsPath, appdtest.ExpiredToken)
+
+	apps, err := ctrl.GetApplications(ctx)
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+	if len(apps) != 6 {
+		t.Errorf("got %v applications, want 6", len(apps))
+	}
+
+	if got := server.Requests("/api/oauth/access_token"); got != 2 {
+		t.Errorf("got %v access token requests, want 2", got)
+	}
+
+}
+
+func TestRejectedCredentials(t *testing.T) {
+
+	server := appdtest.NewServer()
+	defer server.Close()
+
+	conf := server.Config()
+	conf.Secret = "wrong"
+
+	ctrl, err := appd.NewController(conf)
+	if err != nil {
+		t.Fatalf("NewController: %v", err)
+	}
+
+	_, err = ctrl.GetAccessToken(context.Background())
+
+	var authErr *appd.AuthError
+	if !errors.As(err, &authErr) || !errors.Is(err, appd.ErrAuthentication) {
+		t.Errorf("GetAccessToken error = %v, want an AuthError", err)
+	}
+
+}
+
+func TestRateLimitedHonorsRetryAfter(t *testing.T) {
+
+	server, ctrl := newController(t)
+
+	server.Fail(applicationsPath, appdtest.RateLimited)
+
+	start := time.Now()
+	if _, err := ctrl.GetApplications(context.Background()); err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+
+	// The mock asks to retry after 1s, way over the configured backoff
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want at least the 1s Retry-After", elapsed)
+	}
+	if got := server.Requests(applicationsPath); got != 2 {
+		t.Errorf("got %v applications requests, want 2", got)
+	}
+
+}
+
+func TestRateLimitedAfterRetries(t *testing.T) {
+
+	server, ctrl := newController(t)
+
+	server.Fail(applicationsPath, appdtest.RateLimited, appdtest.RateLimited, appdtest.RateLimited)
+
+	_, err := ctrl.GetApplications(context.Background())
+
+	var rateErr *appd.RateLimitedError
+	if !errors.As(err, &rateErr) || !errors.Is(err, appd.ErrRateLimited) {
+		t.Fatalf("GetApplications error = %v, want a RateLimitedError", err)
+	}
+	if rateErr.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %v, want 1s", rateErr.RetryAfter)
+	}
+
+}
+
+func TestServerErrorIsRetried(t *testing.T) {
+
+	server, ctrl := newController(t)
+
+	server.Fail(applicationsPath, appdtest.ServerError, appdtest.ServerError)
+
+	apps, err := ctrl.GetApplications(context.Background())
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+	if len(apps) != 6 {
+		t.Errorf("got %v applications, want 6", len(apps))
+	}
+	if got := server.Requests(applicationsPath); got != 3 {
+		t.Errorf("got %v applications requests, want 3", got)
+	}
+
+}
+
+func TestServerErrorAfterRetries(t *testing.T) {
+
+	server, ctrl := newController(t)
+
+	server.Fail(applicationsPath, appdtest.ServerError, appdtest.ServerError, appdtest.ServerError)
+
+	_, err := ctrl.GetApplications(context.Background())
+	if !errors.Is(err, &appd.HTTPStatusError{StatusCode: http.StatusInternalServerError}) {
+		t.Errorf("GetApplications error = %v, want HTTP state 500", err)
+	}
+
+}
+
+func TestMalformedJSON(t *testing.T) {
+
+	server, ctrl := newController(t)
+
+	server.Fail(applicationsPath, appdtest.MalformedJSON)
+
+	_, err := ctrl.GetApplications(context.Background())
+
+	var decodeErr *appd.DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Errorf("GetApplications error = %v, want a DecodeError", err)
+	}
+
+}
+
+func TestMalformedJSONIsRecordedPerApp(t *testing.T) {
+
+	server, ctrl := newController(t)
+	ctx := context.Background()
+
+	apps, err := ctrl.GetApplications(ctx)
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+
+	server.Fail("/controller/alerting/rest/v1/applications/11/health-rules", appdtest.MalformedJSON)
+
+	apps, err = ctrl.GetHealthRules(ctx, apps)
+	if err == nil {
+		t.Fatal("GetHealthRules succeeded, want a failure for ecommerce-web")
+	}
+
+	for _, app := range apps {
+
+		failed := app.Failed(appd.FetchHealthRules)
+		if failed != (app.Id == 11) {
+			t.Errorf("%v: Failed(%q) = %v", app.Name, appd.FetchHealthRules, failed)
+		}
+		if failed && app.Alerting != nil {
+			t.Errorf("%v: kept %v health rules of a failed fetch", app.Name, len(app.Alerting))
+		}
+
+	}
+
+}
+
+func TestFailedHealthRuleDetailsAreNotKept(t *testing.T) {
+
+	server, ctrl := newController(t)
+	ctx := context.Background()
+
+	apps, err := ctrl.GetApplications(ctx)
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+	if apps, err = ctrl.GetHealthRules(ctx, apps); err != nil {
+		t.Fatalf("GetHealthRules: %v", err)
+	}
+
+	// Third rule of ecommerce-web
+	server.Fail("/controller/alerting/rest/v1/applications/11/health-rules/103", appdtest.MalformedJSON)
+
+	if apps, err = ctrl.GetHealthRuleDetails(ctx, apps); err == nil {
+		t.Fatal("GetHealthRuleDetails succeeded, want a failure for ecommerce-web")
+	}
+
+	for _, app := range apps {
+
+		detailed := 0
+		for _, rule := range app.Alerting {
+			if rule.Critical != nil || rule.Warning != nil {
+				detailed++
+			}
+		}
+
+		switch {
+		case app.Id == 11 && (detailed > 0 || !app.Failed(appd.FetchHealthRuleDetails)):
+			t.Errorf("%v: %v of %v rules detailed after a failure (%v)", app.Name, detailed, len(app.Alerting), app.Failures)
+		case app.Id != 11 && detailed != len(app.Alerting):
+			t.Errorf("%v: %v of %v rules detailed", app.Name, detailed, len(app.Alerting))
+		}
+
+	}
+
+	// Flagged as incomplete in the export
+	profile := filepath.Join(t.TempDir(), "mock")
+	if err := appd.GenerateHealthRulesJSON(profile, apps); err != nil {
+		t.Fatalf("GenerateHealthRulesJSON: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(profile + "-health-rules.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var export []struct {
+		Id         int64    `json:"id"`
+		Incomplete []string `json:"incomplete"`
+	}
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, app := range export {
+		if incomplete := len(app.Incomplete) > 0; incomplete != (app.Id == 11) {
+			t.Errorf("application %v: incomplete %v", app.Id, app.Incomplete)
+		}
+	}
+
+}
+
+func TestGetPerformanceSeries(t *testing.T) {
+
+	_, ctrl := newController(t)
+	ctx := context.Background()
+
+	apps, err := ctrl.GetApplications(ctx)
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+
+	end := time.Now()
+	apps, err = ctrl.GetPerformanceSeries(ctx, apps, end.Add(-24*time.Hour).UnixMilli(), end.UnixMilli())
+	if err != nil {
+		t.Fatalf("GetPerformanceSeries: %v", err)
+	}
+
+	// ecommerce-web has both metrics in the fixtures, with several points
+	for _, value := range apps[0].PerformanceSeries {
+		if !value.Found || len(value.Series) == 0 || len(value.Series[0].Points) < 2 {
+			t.Errorf("%v: got %+v, want a series", value.Name, value)
+		}
+	}
+	if len(apps[0].PerformanceSeries) != len(appd.PerformanceSeries) {
+		t.Errorf("got %v performance series, want %v", len(apps[0].PerformanceSeries), len(appd.PerformanceSeries))
+	}
+
+}
+
+func TestTooLargeStatsBatchIsSplit(t *testing.T) {
+
+	server := appdtest.NewServer()
+	defer server.Close()
+
+	server.MaxStatsBatch = 2
+
+	conf := server.Config()
+	conf.StatsBatchSize = 6
+
+	ctrl, err := appd.NewController(conf)
+	if err != nil {
+		t.Fatalf("NewController: %v", err)
+	}
+
+	ctx := context.Background()
+
+	apps, err := ctrl.GetApplications(ctx)
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+
+	end := time.Now()
+	apps, err = ctrl.GetAllAppsSummaryStats(ctx, apps, end.Add(-24*time.Hour).UnixMilli(), end.UnixMilli())
+	if err != nil {
+		t.Fatalf("GetAllAppsSummaryStats: %v", err)
+	}
+
+	for _, app := range apps {
+
+		// legacy-batch has no statistics in the fixtures, which isn't a failure
+		if missing := app.Id == 15; app.StatsMissing != missing {
+			t.Errorf("%v: StatsMissing = %v, want %v", app.Name, app.StatsMissing, missing)
+		}
+		if app.Failed(appd.FetchStatistics) {
+			t.Errorf("%v: got statistics failures %v", app.Name, app.Failures)
+		}
+
+		if app.Id == 12 && app.Metrics.NumberOfCalls != 9523381 {
+			t.Errorf("%v: NumberOfCalls = %v, want 9523381", app.Name, app.Metrics.NumberOfCalls)
+		}
+
+	}
+
+	// 6 apps, split in 3 + 3, each split in 1 + 2
+	if got := server.Requests("/controller/restui/v1/app/list/ids"); got != 7 {
+		t.Errorf("got %v statistics requests, want 7", got)
+	}
+
+}
+
+func TestFailedStatsBatchIsRecorded(t *testing.T) {
+
+	server, ctrl := newController(t)
+	ctx := context.Background()
+
+	apps, err := ctrl.GetApplications(ctx)
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+
+	server.Fail("/controller/restui/", appdtest.ServerError, appdtest.ServerError, appdtest.ServerError)
+
+	end := time.Now()
+	apps, err = ctrl.GetAllAppsSummaryStats(ctx, apps, end.Add(-24*time.Hour).UnixMilli(), end.UnixMilli())
+	if !errors.Is(err, &appd.HTTPStatusError{StatusCode: http.StatusInternalServerError}) {
+		t.Fatalf("GetAllAppsSummaryStats error = %v, want HTTP state 500", err)
+	}
+
+	calls, _ := appd.LookupColumn("calls")
+
+	for _, app := range apps {
+
+		if !app.Failed(appd.FetchStatistics) || !app.StatsMissing {
+			t.Errorf("%v: statistics failure not recorded, got %v", app.Name, app.Failures)
+		}
+		if value := calls.Value(app); value != "" {
+			t.Errorf("%v: calls = %v, want it empty", app.Name, value)
+		}
+
+	}
+
+}
+
+func TestCancelled(t *testing.T) {
+
+	server, ctrl := newController(t)
+
+	apps, err := ctrl.GetApplications(context.Background())
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := ctrl.GetApplications(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetApplications error = %v, want context.Canceled", err)
+	}
+
+	if _, err := ctrl.GetHealthRules(ctx, apps); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetHealthRules error = %v, want context.Canceled", err)
+	}
+
+	if got := server.Requests(applicationsPath); got != 1 {
+		t.Errorf("got %v applications requests, want only the one before cancelling", got)
+	}
+
+}
@@ -0,0 +1,332 @@
+package appd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CustomMetricColumnPrefix prefixes the key of custom metric columns, eg
+// "metric:Avg Response Time (ms)".
+const CustomMetricColumnPrefix = "metric:"
+
+// Column is one column of the application table written by the Excel report
+// and GenerateCSV. Value returns a number, a string, or "" when the app has
+// no value. Format is the Excel number format of the column (eg "#,##0.00"),
+// General when empty.
+type Column struct {
+	Key    string
+	Header string
+	Format string
+	Value  func(app AppDetails) interface{}
+}
+
+// columns is the column registry, see LookupColumn.
+var columns = []Column{
+	{"application", "Application", "", func(app AppDetails) interface{} {
+		return app.Name
+	}},
+	{"controller", "Controller", "", func(app AppDetails) interface{} {
+		return app.Controller
+	}},
+	{"errors", "Number of Errors", "", withStats(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfErrors
+	})},
+	{"calls", "Number of Calls", "", withStats(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfCalls
+	})},
+	{"errorsperminute", "Errors per Minute", "", withStats(func(app AppDetails) interface{} {
+		return app.Metrics.ErrorsPerMinute
+	})},
+	{"callsperminute", "Calls per Minute", "", withStats(func(app AppDetails) interface{} {
+		return app.Metrics.CallsPerMinute
+	})},
+	{"errorrate", "Error Rate %", "", func(app AppDetails) interface{} {
+		if rate, ok := app.Metrics.ErrorRate(); ok {
+			return math.Round(rate*100) / 100
+		}
+		return ""
+	}},
+	{"responsetime", "Avg Response Time (ms)", "", func(app AppDetails) interface{} {
+		if app.Metrics.NumberOfCalls > 0 {
+			return math.Round(app.Metrics.AverageResponseTime*10) / 10
+		}
+		return ""
+	}},
+	{"enabledalerts", "Enabled Alerts", "", unlessFailed(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfActiveHealthRules
+	}, FetchHealthRules)},
+	{"disabledalerts", "Disabled Alerts", "", unlessFailed(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfInactiveHealthRules
+	}, FetchHealthRules)},
+	{"alertlist", "Alert List", "", unlessFailed(func(app AppDetails) interface{} {
+		return alertList(app.Alerting)
+	}, FetchHealthRules)},
+	{"tiers", "Tiers", "", unlessFailed(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfTiers
+	}, FetchTiersAndNodes)},
+	{"nodes", "Nodes", "", unlessFailed(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfNodes
+	}, FetchTiersAndNodes)},
+	{"agentcompliance", "Agent Compliance %", "", func(app AppDetails) interface{} {
+		if percent := app.AgentCompliance.Percent(); percent >= 0 {
+			return math.Round(percent*10) / 10
+		}
+		return ""
+	}},
+	{"violations", "Violations", "", unlessFailed(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfViolations
+	}, FetchViolations)},
+	{"criticalviolations", "Critical Violations", "", unlessFailed(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfCriticalViolations
+	}, FetchViolations)},
+	{"warningviolations", "Warning Violations", "", unlessFailed(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfWarningViolations
+	}, FetchViolations)},
+	{"timeinviolation", "Time in Violation (h)", "", unlessFailed(func(app AppDetails) interface{} {
+		return math.Round(app.Metrics.TimeInViolation.Hours()*10) / 10
+	}, FetchViolations)},
+	{"orphanedrules", "Orphaned Rules", "", unlessFailed(func(app AppDetails) interface{} {
+		return app.Metrics.NumberOfOrphanedHealthRules
+	}, FetchHealthRules, FetchPolicies)},
+	{"notificationpath", "Notification Path", "", unlessFailed(func(app AppDetails) interface{} {
+		return yesNo(app.NotificationPath)
+	}, FetchHealthRules, FetchPolicies)},
+	{"statsmissing", "Stats Missing", "", func(app AppDetails) interface{} {
+		return yesNo(app.StatsMissing)
+	}},
+	{"collectionerrors", "Collection Errors", "", func(app AppDetails) interface{} {
+		return strings.Join(app.Failures, "; ")
+	}},
+}
+
+// defaultColumns are the keys of the main table of the Excel report.
+var defaultColumns = []string{
+	"application",
+	"errors",
+	"calls",
+	"errorrate",
+	"responsetime",
+	"enabledalerts",
+	"disabledalerts",
+	"tiers",
+	"nodes",
+	"agentcompliance",
+	"violations",
+	"criticalviolations",
+	"warningviolations",
+	"timeinviolation",
+	"orphanedrules",
+	"notificationpath",
+	"statsmissing",
+	"collectionerrors",
+}
+
+// defaultCSVColumns are the columns written by GenerateCSV, with the headers
+// (and values, see legacyCSVValues) of the CSV export from before columns
+// could be selected, so existing consumers keep working.
+var defaultCSVColumns = []struct {
+	Key    string
+	Header string
+}{
+	{"application", "Application Name"},
+	{"controller", "Controller"},
+	{"calls", "Number of Calls (last day)"},
+	{"errors", "Number of Errors (last day)"},
+	{"callsperminute", "Calls per Minute (last day)"},
+	{"errorsperminute", "Errors per Minute (last day)"},
+	{"enabledalerts", "Active Alerts (health rules)"},
+	{"disabledalerts", "Inactive Alerts (health rules)"},
+	{"alertlist", "Alert List (name, id, enabled)"},
+	{"statsmissing", "Stats Missing"},
+}
+
+// legacyCSVValues are the values of the default CSV columns that used to be
+// formatted differently.
+var legacyCSVValues = map[string]func(app AppDetails) interface{}{
+	"alertlist": func(app AppDetails) interface{} {
+		rules := make([]string, len(app.Alerting))
+		for i, rule := range app.Alerting {
+			rules[i] = fmt.Sprintf("{%v %v %v}", rule.Name, rule.Id, rule.Active)
+		}
+		return "[" + strings.Join(rules, " ") + "]"
+	},
+	"statsmissing": func(app AppDetails) interface{} {
+		return fmt.Sprint(app.StatsMissing)
+	},
+}
+
+// LookupColumn returns the column of the given key: one of ColumnKeys, or
+// CustomMetricColumnPrefix followed by the name of a custom metric.
+func LookupColumn(key string) (Column, bool) {
+
+	// Custom metric, empty when the Controller had no data
+	if name := strings.TrimPrefix(key, CustomMetricColumnPrefix); name != key && name != "" {
+		return Column{
+			Key:    key,
+			Header: name,
+			Value: func(app AppDetails) interface{} {
+				for _, metric := range app.CustomMetrics {
+					if metric.Name == name && metric.Found {
+						return math.Round(metric.Value*100) / 100
+					}
+				}
+				return ""
+			},
+		}, true
+	}
+
+	for _, column := range columns {
+		if column.Key == key {
+			return column, true
+		}
+	}
+
+	return Column{}, false
+
+}
+
+// ColumnKeys returns the keys of the registered columns, sorted.
+func ColumnKeys() []string {
+
+	keys := make([]string, len(columns))
+	for i, column := range columns {
+		keys[i] = column.Key
+	}
+	sort.Strings(keys)
+
+	return keys
+
+}
+
+// DefaultColumns returns the columns of the main table of the Excel report,
+// followed by a column per custom metric.
+func DefaultColumns(metrics []CustomMetric) []Column {
+
+	selected := lookupColumns(defaultColumns)
+	for _, metric := range metrics {
+		column, _ := LookupColumn(CustomMetricColumnPrefix + metric.Name)
+		selected = append(selected, column)
+	}
+
+	return selected
+
+}
+
+// DefaultCSVColumns returns the columns written by GenerateCSV, laid out as
+// the CSV export always was.
+func DefaultCSVColumns() []Column {
+
+	selected := make([]Column, 0, len(defaultCSVColumns))
+	for _, c := range defaultCSVColumns {
+
+		column, ok := LookupColumn(c.Key)
+		if !ok {
+			continue
+		}
+
+		column.Header = c.Header
+		if value, ok := legacyCSVValues[c.Key]; ok {
+			column.Value = value
+		}
+
+		selected = append(selected, column)
+
+	}
+
+	return selected
+
+}
+
+// lookupColumns returns the registered columns of the given keys.
+func lookupColumns(keys []string) []Column {
+
+	selected := make([]Column, 0, len(keys))
+	for _, key := range keys {
+		if column, ok := LookupColumn(key); ok {
+			selected = append(selected, column)
+		}
+	}
+
+	return selected
+
+}
+
+// FormatValue formats a column value for text outputs such as CSV.
+func FormatValue(value interface{}) string {
+
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+
+	return fmt.Sprint(value)
+
+}
+
+// ErrorRate returns the errors in % of calls. ok is false without calls.
+func (m AppMetrics) ErrorRate() (rate float64, ok bool) {
+
+	if m.NumberOfCalls <= 0 {
+		return 0, false
+	}
+
+	return float64(m.NumberOfErrors) * 100 / float64(m.NumberOfCalls), true
+
+}
+
+// alertList lists health rules with their state, eg "Rule A (enabled), Rule
+// B (disabled)".
+func alertList(rules []AppHealthRules) string {
+
+	list := make([]string, len(rules))
+	for i, rule := range rules {
+		state := "disabled"
+		if rule.Active {
+			state = "enabled"
+		}
+		list[i] = fmt.Sprintf("%v (%v)", rule.Name, state)
+	}
+
+	return strings.Join(list, ", ")
+
+}
+
+// unlessFailed returns value, or "" for apps where any of what (Fetch
+// constants) failed, so a missing value isn't read as 0.
+func unlessFailed(value func(app AppDetails) interface{}, what ...string) func(app AppDetails) interface{} {
+	return func(app AppDetails) interface{} {
+		for _, w := range what {
+			if app.Failed(w) {
+				return ""
+			}
+		}
+		return value(app)
+	}
+}
+
+// withStats wraps a column value coming from the summary statistics so it is
+// left empty when they are missing for the app, see AppDetails.HasStats.
+func withStats(value func(app AppDetails) interface{}) func(app AppDetails) interface{} {
+	return func(app AppDetails) interface{} {
+		if !app.HasStats() {
+			return ""
+		}
+		return value(app)
+	}
+}
+
+// yesNo formats a flag for reports.
+func yesNo(flag bool) string {
+
+	if flag {
+		return "Yes"
+	}
+
+	return "No"
+
+}
@@ -0,0 +1,187 @@
+package appd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MachineAgent is the agent type used in an AgentPolicy for machine agents.
+const MachineAgent = "MACHINE_AGENT"
+
+// agentVersion finds the version number in agent version strings such as
+// "Server Agent #23.10.0.35234 v23.10.0 GA compatible with 4.4.1.0".
+var agentVersion = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// AgentPolicy maps agent types (APP_AGENT, DOT_NET_APP_AGENT, MACHINE_AGENT,
+// ...) to the minimum version allowed, eg "23.1.0". Agent types missing from
+// the policy are not audited.
+type AgentPolicy map[string]string
+
+// AgentCompliance is the result of the agent version audit of an app.
+type AgentCompliance struct {
+	Audited    int
+	Compliant  int
+	Violations []AgentViolation
+}
+
+// AgentViolation is an agent running a version older than the policy allows,
+// or whose version couldn't be read.
+type AgentViolation struct {
+	Tier       string
+	Node       string
+	Machine    string
+	AgentType  string
+	Version    string
+	MinVersion string
+	Reason     string
+}
+
+// Percent returns the share of audited agents within policy, or -1 if no
+// agent of the app was audited.
+func (a AgentCompliance) Percent() float64 {
+
+	if a.Audited == 0 {
+		return -1
+	}
+
+	return float64(a.Compliant) * 100 / float64(a.Audited)
+
+}
+
+// CheckAgentCompliance audits the app and machine agents of every node of
+// the given applications (see GetTiersAndNodes) against policy, and stores
+// the result in AgentCompliance. Machine agents are audited once per machine.
+// Nodes without an app agent and machines without a machine agent are left
+// out.
+func CheckAgentCompliance(appsinfo []AppDetails, policy AgentPolicy) ([]AppDetails, error) {
+
+	// Parse the policy first
+	minimums := map[string][]int{}
+	for agentType, version := range policy {
+
+		parsed, ok := parseAgentVersion(version)
+		if !ok {
+			return appsinfo, fmt.Errorf("invalid minimum version %q for %v in agent policy", version, agentType)
+		}
+		minimums[agentType] = parsed
+
+	}
+
+	for i := range appsinfo {
+
+		app := &appsinfo[i]
+		app.AgentCompliance = AgentCompliance{}
+
+		machines := map[string]bool{}
+
+		for _, tier := range app.Tiers {
+
+			for _, node := range tier.Nodes {
+
+				// App agent
+				if node.AppAgentPresent {
+					audit(&app.AgentCompliance, minimums, policy, tier, node, node.AgentType, node.AppAgentVersion)
+				}
+
+				// Machine agent, once per machine
+				if !node.MachineAgentPresent || machines[node.MachineName] {
+					continue
+				}
+				machines[node.MachineName] = true
+
+				audit(&app.AgentCompliance, minimums, policy, tier, node, MachineAgent, node.MachineAgentVersion)
+
+			}
+
+		}
+
+	}
+
+	return appsinfo, nil
+
+}
+
+// audit checks one agent against its minimum version, if the policy has one.
+func audit(compliance *AgentCompliance, minimums map[string][]int, policy AgentPolicy, tier AppTier, node AppNode, agentType string, version string) {
+
+	minimum, ok := minimums[agentType]
+	if !ok {
+		return
+	}
+
+	compliance.Audited++
+
+	violation := AgentViolation{
+		Tier:       tier.Name,
+		Node:       node.Name,
+		Machine:    node.MachineName,
+		AgentType:  agentType,
+		Version:    version,
+		MinVersion: policy[agentType],
+	}
+
+	parsed, ok := parseAgentVersion(version)
+	switch {
+	case !ok:
+		violation.Reason = "unknown version"
+	case compareVersions(parsed, minimum) < 0:
+		violation.Reason = "older than minimum version"
+	default:
+		compliance.Compliant++
+		return
+	}
+
+	compliance.Violations = append(compliance.Violations, violation)
+
+}
+
+// parseAgentVersion extracts the first dotted version number of s.
+func parseAgentVersion(s string) ([]int, bool) {
+
+	match := agentVersion.FindString(s)
+	if match == "" {
+		return nil, false
+	}
+
+	var version []int
+	for _, part := range strings.Split(match, ".") {
+
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		version = append(version, n)
+
+	}
+
+	return version, true
+
+}
+
+// compareVersions compares two versions part by part, missing parts being 0.
+func compareVersions(a []int, b []int) int {
+
+	for i := 0; i < len(a) || i < len(b); i++ {
+
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+
+	}
+
+	return 0
+
+}
@@ -0,0 +1,113 @@
+package appd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseAgentVersion(t *testing.T) {
+
+	for _, test := range []struct {
+		s    string
+		want []int
+		ok   bool
+	}{
+		{"Server Agent #23.10.0.35234 v23.10.0 GA compatible with 4.4.1.0", []int{23, 10, 0, 35234}, true},
+		{"Server Agent v4.5.19.0 GA #12345 r98765 compatible with 4.4.1.0", []int{4, 5, 19, 0}, true},
+		{"Machine Agent v23.9.0.3867 GA compatible with 4.4.1.0 Build Date 2023-09-20 10:47:26", []int{23, 9, 0, 3867}, true},
+		{"23.1", []int{23, 1}, true},
+		{"23.1.0", []int{23, 1, 0}, true},
+		{"", nil, false},
+		{"unknown", nil, false},
+		{"Server Agent 23", nil, false},
+	} {
+
+		got, ok := parseAgentVersion(test.s)
+		if ok != test.ok || fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("parseAgentVersion(%q) = %v, %v, want %v, %v", test.s, got, ok, test.want, test.ok)
+		}
+
+	}
+
+}
+
+func TestCompareVersions(t *testing.T) {
+
+	for _, test := range []struct {
+		a, b []int
+		want int
+	}{
+		{[]int{23, 1}, []int{23, 1, 0}, 0},
+		{[]int{23, 1, 0}, []int{23, 1}, 0},
+		{[]int{23, 1, 0, 5}, []int{23, 1}, 1},
+		{[]int{23, 10, 0}, []int{23, 9, 5}, 1},
+		{[]int{4, 5, 19}, []int{23, 1, 0}, -1},
+		{nil, []int{0, 0}, 0},
+	} {
+
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+
+	}
+
+}
+
+func TestCheckAgentCompliance(t *testing.T) {
+
+	apps := []AppDetails{{
+		Name: "ecommerce-web",
+		Tiers: []AppTier{{
+			Name: "web",
+			Nodes: []AppNode{
+				// Compliant app agent, machine agent too old
+				{Name: "web-1", MachineName: "host-1", AgentType: "APP_AGENT", AppAgentPresent: true,
+					AppAgentVersion:     "Server Agent #23.10.0.35234 v23.10.0 GA compatible with 4.4.1.0",
+					MachineAgentPresent: true, MachineAgentVersion: "Machine Agent v22.1.0.3000 GA compatible with 4.4.1.0"},
+				// Same machine, its machine agent isn't audited twice
+				{Name: "web-2", MachineName: "host-1", AgentType: "APP_AGENT", AppAgentPresent: true,
+					AppAgentVersion:     "Server Agent v4.5.19.0 GA compatible with 4.4.1.0",
+					MachineAgentPresent: true, MachineAgentVersion: "Machine Agent v22.1.0.3000 GA compatible with 4.4.1.0"},
+				// Present agent without a readable version
+				{Name: "web-3", MachineName: "host-3", AgentType: "APP_AGENT", AppAgentPresent: true},
+				// No agents at all
+				{Name: "web-4", MachineName: "host-4", AgentType: "APP_AGENT"},
+				// Agent type without a minimum version
+				{Name: "web-5", MachineName: "host-5", AgentType: "NODEJS_APP_AGENT", AppAgentPresent: true, AppAgentVersion: "1.0.0"},
+			},
+		}},
+	}}
+
+	apps, err := CheckAgentCompliance(apps, AgentPolicy{"APP_AGENT": "23.1", MachineAgent: "23.1.0"})
+	if err != nil {
+		t.Fatalf("CheckAgentCompliance: %v", err)
+	}
+
+	compliance := apps[0].AgentCompliance
+
+	if compliance.Audited != 4 || compliance.Compliant != 1 {
+		t.Errorf("audited %v, compliant %v, want 4 and 1", compliance.Audited, compliance.Compliant)
+	}
+
+	var got []string
+	for _, v := range compliance.Violations {
+		got = append(got, fmt.Sprintf("%v/%v: %v", v.Node, v.AgentType, v.Reason))
+	}
+	want := []string{
+		"web-1/MACHINE_AGENT: older than minimum version",
+		"web-2/APP_AGENT: older than minimum version",
+		"web-3/APP_AGENT: unknown version",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("violations = %v, want %v", got, want)
+	}
+
+}
+
+func TestCheckAgentComplianceInvalidPolicy(t *testing.T) {
+
+	if _, err := CheckAgentCompliance(nil, AgentPolicy{"APP_AGENT": "latest"}); err == nil {
+		t.Error("CheckAgentCompliance accepted an invalid minimum version")
+	}
+
+}
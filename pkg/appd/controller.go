@@ -1,12 +1,12 @@
 package appd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/big"
 	"net/http"
 	"strings"
 	"time"
@@ -14,9 +14,48 @@ import (
 
 type AppDetails struct {
 	Name     string
-	Id       float64
+	Id       int64
 	Metrics  AppMetrics
 	Alerting []AppHealthRules
+
+	// Name of the Controller (ControllerConfig.Name) the app comes from
+	Controller string
+
+	// Tiers of the app, each with its nodes
+	Tiers []AppTier
+
+	// Business transactions of the app, busiest first
+	BusinessTransactions []AppBusinessTransaction
+
+	// Backends (remote services) called by the app, busiest first
+	Backends []AppBackend
+
+	// Health rule violations in the report time range, oldest first
+	Violations []AppHealthRuleViolation
+
+	// Policies and actions of the app, see GetPolicies
+	Policies []AppPolicy
+	Actions  []AppAction
+
+	// NotificationPath is set when an enabled health rule is routed to a
+	// notification action (email, HTTP request...) by an enabled policy
+	NotificationPath bool
+
+	// Custom metrics configured for the report, see GetCustomMetrics
+	CustomMetrics []CustomMetricValue
+
+	// Calls and response time over time, see GetPerformanceSeries
+	PerformanceSeries []CustomMetricValue
+
+	// Result of the agent version audit, see CheckAgentCompliance
+	AgentCompliance AgentCompliance
+
+	// StatsMissing is set when the Controller returned no summary
+	// statistics for this app, so its metrics are not just zero
+	StatsMissing bool
+
+	// Failures lists what couldn't be collected for this app
+	Failures []string
 }
 type AppMetrics struct {
 	NumberOfErrors              int64   `json:"numberOfErrors"`
@@ -26,14 +65,67 @@ type AppMetrics struct {
 	AverageResponseTime         float64 `json:"averageResponseTime"`
 	NumberOfActiveHealthRules   float64 `json:"NumberOfActiveHealthRules"`
 	NumberOfInactiveHealthRules float64 `json:"NumberOfInactiveHealthRules"`
+	NumberOfTiers               int64   `json:"numberOfTiers"`
+	NumberOfNodes               int64   `json:"numberOfNodes"`
+	NumberOfViolations          int64   `json:"numberOfViolations"`
+	NumberOfCriticalViolations  int64   `json:"numberOfCriticalViolations"`
+	NumberOfWarningViolations   int64   `json:"numberOfWarningViolations"`
+	NumberOfOrphanedHealthRules int64   `json:"numberOfOrphanedHealthRules"`
+
+	// Time spent in violation within the report time range, all violations
+	// added up, overlapping ones of the same rule and entity counted once
+	TimeInViolation time.Duration `json:"timeInViolation"`
 }
 type AppHealthRules struct {
-	Name   string
-	Id     float64
-	Active bool
+	Name   string `json:"name"`
+	Id     int64  `json:"id"`
+	Active bool   `json:"enabled"`
+
+	// What the rule applies to, eg BUSINESS_TRANSACTION_PERFORMANCE and
+	// "SPECIFIC_BUSINESS_TRANSACTIONS: /checkout"
+	AffectedEntityType string `json:"affectedEntityType"`
+	AffectsScope       string `json:"affectsScope"`
+
+	// Schedule name, minutes of data evaluated and minutes to wait after a
+	// violation before re-evaluating
+	Schedule               string `json:"schedule"`
+	EvaluationMinutes      int    `json:"evaluationMinutes"`
+	WaitTimeAfterViolation int    `json:"waitTimeAfterViolation"`
+
+	// Critical and warning conditions, nil when not set
+	Critical *HealthRuleCriteria `json:"critical"`
+	Warning  *HealthRuleCriteria `json:"warning"`
+
+	// Enabled policies triggered by this health rule, see GetPolicies
+	Policies []string `json:"policies"`
+
+	// Orphaned is set when the health rule is enabled but no enabled
+	// policy is triggered by it
+	Orphaned bool `json:"orphaned"`
+}
+type AppTier struct {
+	Name          string
+	Id            int64
+	Type          string
+	AgentType     string
+	NumberOfNodes int
+	Nodes         []AppNode
+}
+type AppNode struct {
+	Name                string
+	Id                  int64
+	MachineName         string
+	MachineOSType       string
+	AgentType           string
+	AppAgentVersion     string
+	MachineAgentVersion string
+
+	// Whether the node has an app agent and its machine a machine agent
+	AppAgentPresent     bool
+	MachineAgentPresent bool
 }
 type AppStatisticsPayload struct {
-	RequestFilter  []int    `json:"requestFilter"`
+	RequestFilter  []int64  `json:"requestFilter"`
 	TimeRangeStart int64    `json:"timeRangeStart"`
 	TimerangeEnd   int64    `json:"timeRangeEnd"`
 	SearchFilters  []string `json:"searchFilters"`
@@ -43,154 +135,113 @@ type AppStatisticsPayload struct {
 	Limit          int      `json:"limit"`
 }
 
-func GetEntitiesFromController(URL string, controllerAccessToken string) ([]AppDetails, error) {
+// GetApplications returns all APM applications registered on the Controller.
+func (c *Controller) GetApplications(ctx context.Context) ([]AppDetails, error) {
 
-	var jsonArrInterface []interface{}
 	var apps []AppDetails
 
-	// Set HTTP request method
-	method := "GET"
-
-	// timeout
-	timeout := time.Duration(60 * time.Second)
-
-	// http client
-	client := &http.Client{}
-
-	// client
-	client = &http.Client{
-		Timeout:   timeout,
-		Transport: &http.Transport{},
-	}
-
-	// Create a new HTTP request object
-	req, err := http.NewRequest(method, URL, nil)
+	// Make the HTTP request to the Controller and decode the APM apps list
+	// one app at a time
+	err := c.stream(ctx, authToken, "GET", "/controller/rest/applications?output=json", nil, func(dec *json.Decoder) error {
 
-	// Return error if new request creation fails
-	if err != nil {
-		log.Printf("ERROR - %v", err)
-		return nil, err
-	}
+		var application applicationResponse
+		if err := dec.Decode(&application); err != nil {
+			return err
+		}
 
-	// Set HTTP headers
-	req.Header.Set("Authorization", "Bearer "+controllerAccessToken)
+		apps = append(apps, AppDetails{
+			Name:       application.Name,
+			Id:         application.Id,
+			Controller: c.Name,
+		})
 
-	// Make the HTTP request to the Controller
-	res, err := client.Do(req)
+		return nil
 
-	// If non-http error is returned from response we quit this goroutine
+	})
 	if err != nil {
-		log.Printf("ERROR - %v", err)
 		return nil, err
 	}
 
-	// Close the body stream to avoid leaks later
-	defer res.Body.Close()
-
-	// Read the body into a byte var
-	body, err := ioutil.ReadAll(res.Body)
-
-	// If there is an error while reading response body we quit this function
-	if err != nil {
-		log.Printf("ERROR - %v", err)
-		return nil, err
-	}
+	return apps, nil
 
-	// If HTTP state from controller is bad we quit this goroutine
-	if res.StatusCode != 200 {
-		log.Printf("ERROR - Got HTTP state %v while calling %v. %v", res.StatusCode, URL, string(body))
-		return nil, errors.New(fmt.Sprint(res.StatusCode))
-	}
+}
 
-	// Unmarshal retrieved APM apps list
-	json.Unmarshal(body, &jsonArrInterface)
+// GetAccessToken requests a temporary OAuth access token for the API client
+// and keeps it on the Controller for subsequent REST API calls. The token is
+// refreshed automatically before it expires. Rejected credentials are
+// returned as an AuthError.
+func (c *Controller) GetAccessToken(ctx context.Context) (string, error) {
 
-	for i := range jsonArrInterface {
-		appdetails := AppDetails{
-			Name: jsonArrInterface[i].(map[string]interface{})["name"].(string),
-			Id:   jsonArrInterface[i].(map[string]interface{})["id"].(float64),
-		}
-		apps = append(apps, appdetails)
-	}
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
 
-	return apps, nil
+	return c.requestAccessToken(ctx)
 
 }
 
-func GetControllerAccessToken(clientName string, account string, clientSecret string, controllerUrl string) (error, string) {
+// requestAccessToken does the actual token request. Callers must hold authMu.
+func (c *Controller) requestAccessToken(ctx context.Context) (string, error) {
 
-	var jsonMap map[string]interface{}
+	var tokenResponse accessTokenResponse
 
 	// Set HTTP request method
 	method := "POST"
 
-	// timeout
-	timeout := time.Duration(60 * time.Second)
-
 	// Convert HTTP request payload
-	authpayload := "grant_type=client_credentials&client_id=" + clientName + "@" + account + "&client_secret=" + clientSecret
+	authpayload := "grant_type=client_credentials&client_id=" + c.Client + "@" + c.Account + "&client_secret=" + c.Secret
 	payload := strings.NewReader(authpayload)
 
 	// Set the auth URL
-	authurl := controllerUrl + "/api/oauth/access_token"
-
-	// http client
-	client := &http.Client{}
-
-	// client
-	client = &http.Client{
-		Timeout:   timeout,
-		Transport: &http.Transport{},
-	}
+	authurl := c.URL + "/api/oauth/access_token"
 
 	// Create a new HTTP request object
-	req, err := http.NewRequest(method, authurl, payload)
+	req, err := http.NewRequestWithContext(ctx, method, authurl, payload)
 
 	// If there is an error while trying to create new http request object we quit this goroutine
 	if err != nil {
 		log.Printf("ERROR - %v", err)
-		return err, ""
+		return "", err
 	}
 
 	// Add the needed headers for temporary access token request
 	req.Header.Add("Content-Type", "application/vnd.appd.cntrl+protobuf;v=1")
 
 	// Make the HTTP request to the Controller
-	res, err := client.Do(req)
+	res, err := c.send(req, true)
 
 	// If non-http error is returned from response we quit this goroutine
 	if err != nil {
 		log.Printf("ERROR - %v", err)
-		return err, ""
+		return "", err
 	}
 
-	// Close the body stream to avoid leaks later
-	defer res.Body.Close()
-
-	// Read the body into a byte var
-	body, err := ioutil.ReadAll(res.Body)
-
-	// If there is an error while reading response body we quit this goroutine
-	if err != nil {
-		log.Printf("ERROR - %v", err)
-		return err, ""
-	}
+	// Read the (buffered) body into a byte var and close the stream
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
 
 	// If HTTP state from controller is bad we quit this goroutine
 	if res.StatusCode != 200 {
 		log.Printf("ERROR - Got HTTP state %v while waiting for temp access token from Controller.", res.StatusCode)
-		return errors.New(fmt.Sprint(res.StatusCode)), ""
+		return "", &AuthError{Op: "access token request", URL: authurl, Err: newHTTPStatusError(req, res, body)}
 	}
 
 	log.Printf("Got temp access token from Controller (http %v).", res.StatusCode)
 
 	// Extract the Controller temporary access token from the body
-	// Access tokens are valid for 5 minutes by default
-	json.Unmarshal(body, &jsonMap)
-	controllerAccessTokenRaw := jsonMap["access_token"]
+	if err := decodeJSON(authurl, body, &tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", &AuthError{Op: "access token request", URL: authurl, Err: errors.New("no access_token in response")}
+	}
 
-	// Convert the access token to string
-	controllerAccessToken := fmt.Sprint(controllerAccessTokenRaw)
+	// Track when the token expires (expires_in is in seconds)
+	lifetime := defaultTokenLifetime
+	if tokenResponse.ExpiresIn > 0 {
+		lifetime = time.Duration(tokenResponse.ExpiresIn) * time.Second
+	}
+
+	controllerAccessToken := tokenResponse.AccessToken
 
 	// Validate temporary access token based on length if more than 100
 	// Typical length is around 600
@@ -200,52 +251,62 @@ func GetControllerAccessToken(clientName string, account string, clientSecret st
 		log.Printf("WARN - Got a shorter access token from Controller. Expected >100 chars, got %v).", len(controllerAccessToken))
 	}
 
-	return nil, controllerAccessToken
+	// Keep the token for subsequent calls
+	c.token = controllerAccessToken
+	c.tokenExpiry = time.Now().Add(lifetime)
+	c.tokenGen++
+
+	log.Printf("Access token expires in %v.", lifetime)
+
+	return controllerAccessToken, nil
+
+}
+
+// GetLoginCookies logs in to the Controller UI with basic auth and keeps the
+// JSESSIONID and X-CSRF-TOKEN cookies for subsequent restui calls. The
+// session is renewed automatically when the Controller rejects it. Rejected
+// credentials are returned as an AuthError.
+func (c *Controller) GetLoginCookies(ctx context.Context) ([]*http.Cookie, error) {
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	return c.requestLoginCookies(ctx)
 
 }
 
-func GetLoginCookies(controllerUrl string, auth string) (error, []*http.Cookie) {
+// requestLoginCookies does the actual login. Callers must hold authMu.
+func (c *Controller) requestLoginCookies(ctx context.Context) ([]*http.Cookie, error) {
 
 	var (
 		cookies []*http.Cookie
 	)
 
 	// Login URL
-	loginurl := controllerUrl + "/auth?action=login"
+	loginurl := c.URL + "/auth?action=login"
 
 	log.Printf("Calling %v for login cookies.", loginurl)
 
-	// Set HTTP client timeout
-	timeout := time.Duration(60 * time.Second)
-
-	// http client
-	clientAppdController := &http.Client{}
-
-	// client
-	clientAppdController = &http.Client{
-		Timeout:   timeout,
-		Transport: &http.Transport{},
-	}
-
 	// Get new request object
-	req, err := http.NewRequest("GET", loginurl, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", loginurl, nil)
 	if err != nil {
-		fmt.Println(err)
-		return err, nil
+		log.Printf("ERROR - %v", err)
+		return nil, err
 	}
 
-	// Authorization based on Controller temporary access token (OAuth)
-	req.Header.Add("Authorization", "Basic "+auth)
+	// Authorization based on base64 account@user:password
+	req.Header.Add("Authorization", "Basic "+c.Auth)
 
 	// Make the call to Controller
-	resp, err := clientAppdController.Do(req)
+	resp, err := c.send(req, true)
 	if err != nil {
-		fmt.Println(err)
-		return err, nil
+		log.Printf("ERROR - %v", err)
+		return nil, err
 	}
 
-	// Close the response stream
-	defer resp.Body.Close()
+	// Read the (buffered) body into a byte var and close the stream
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 
 	// Validate if login cookies are returned by Controller, and then extract them
 	if resp.StatusCode == 200 && strings.Contains(fmt.Sprint(resp.Cookies()), "JSESSIONID") && strings.Contains(fmt.Sprint(resp.Cookies()), "X-CSRF-TOKEN") {
@@ -269,27 +330,183 @@ func GetLoginCookies(controllerUrl string, auth string) (error, []*http.Cookie)
 	} else {
 
 		// Error out if required cookies are not returned
-		errmsg := errors.New("ERROR - Couldn't find JSESSIONID/X-CSRF-TOKEN in Controller response (http " + fmt.Sprint(resp.StatusCode) + "). Cookies: " + fmt.Sprint(resp.Cookies()))
-		log.Println(errmsg)
-		return errmsg, nil
+		log.Printf("ERROR - Couldn't find JSESSIONID/X-CSRF-TOKEN in Controller response (http %v). Cookies: %v", resp.StatusCode, resp.Cookies())
+
+		if resp.StatusCode != 200 {
+			return nil, &AuthError{Op: "login", URL: loginurl, Err: newHTTPStatusError(req, resp, body)}
+		}
+
+		return nil, &AuthError{Op: "login", URL: loginurl, Err: errors.New("no JSESSIONID/X-CSRF-TOKEN cookies in response")}
 
 	}
 
 	log.Println("Got login cookies for Controller.")
 
-	return nil, cookies
+	// Keep the cookies for subsequent calls
+	c.cookies = cookies
+	c.sessionGen++
+
+	return cookies, nil
 
 }
 
-func GetAllAppsSummaryStats(controllerUrl string, login []*http.Cookie, appsinfo []AppDetails, startTime int64, endTime int64) (error, []AppDetails) {
+// HasStats tells if the summary statistics of the app were fetched, its
+// calls and errors being meaningless otherwise.
+func (app AppDetails) HasStats() bool {
+	return !app.StatsMissing && !app.Failed(FetchStatistics)
+}
+
+// GetAllAppsSummaryStats fetches the summary statistics (calls, errors,
+// response time) of the given applications for the given time range.
+// Applications are requested in batches of StatsBatchSize IDs to keep the
+// requests bounded on large controllers. Statistics are matched to
+// applications by ID; apps the Controller returned no statistics for are
+// flagged with StatsMissing, as are the apps of failed batches, which also
+// get the failure recorded in Failures.
+func (c *Controller) GetAllAppsSummaryStats(ctx context.Context, appsinfo []AppDetails, startTime int64, endTime int64) ([]AppDetails, error) {
+
+	var (
+		firstErr error
+		failed   int
+	)
+
+	// Index apps by ID
+	byId := make(map[int64]int, len(appsinfo))
+	for i := range appsinfo {
+		byId[appsinfo[i].Id] = i
+	}
+
+	// Apps we got a stats row for
+	found := make(map[int64]bool, len(appsinfo))
+
+	// One batch of app IDs at a time
+	for from := 0; from < len(appsinfo); from += c.StatsBatchSize {
+
+		to := from + c.StatsBatchSize
+		if to > len(appsinfo) {
+			to = len(appsinfo)
+		}
+
+		// Keep going with the other batches if this one fails
+		rows, err := c.getAppsStatsBatch(ctx, appsinfo[from:to], startTime, endTime)
+		if err != nil {
+
+			// No point in trying the other batches once interrupted
+			last := to
+			if ctx.Err() != nil {
+				last = len(appsinfo)
+			}
+
+			for ii := from; ii < last; ii++ {
+				appsinfo[ii].Failures = append(appsinfo[ii].Failures, fmt.Sprintf("%v: %v", FetchStatistics, err))
+			}
+
+			failed += last - from
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			if ctx.Err() != nil {
+				break
+			}
+
+			continue
+
+		}
+
+		// Get all apps stats
+		for i := range rows {
+
+			appstats := rows[i]
+
+			// Counts may come in scientific notation
+			noc, err := numberToInt64(appstats.NumberOfCalls)
+			if err != nil {
+				log.Printf("WARN - Couldn't parse number of calls %q for %v: %v", appstats.NumberOfCalls, appstats.Name, err)
+			}
+			noe, err := numberToInt64(appstats.NumberOfErrors)
+			if err != nil {
+				log.Printf("WARN - Couldn't parse number of errors %q for %v: %v", appstats.NumberOfErrors, appstats.Name, err)
+			}
+
+			ii, ok := byId[appstats.Id]
+			if !ok {
+				log.Printf("WARN - Got statistics for unexpected application %v (%v).", appstats.Name, appstats.Id)
+				continue
+			}
+			found[appstats.Id] = true
+
+			// Number of Calls
+			appsinfo[ii].Metrics.NumberOfCalls = noc
+
+			// Number of Errors
+			appsinfo[ii].Metrics.NumberOfErrors = noe
+
+			// Average Response Time
+			appsinfo[ii].Metrics.AverageResponseTime = appstats.AverageResponseTime
+
+			// Calls per Minute
+			appsinfo[ii].Metrics.CallsPerMinute = appstats.CallsPerMinute
+
+			// Errors per Minute
+			appsinfo[ii].Metrics.ErrorsPerMinute = appstats.ErrorsPerMinute
+
+		}
+
+	}
+
+	// Flag apps the Controller returned no stats row for, or that couldn't
+	// be fetched
+	for i := range appsinfo {
+		if !found[appsinfo[i].Id] {
+			if !appsinfo[i].Failed(FetchStatistics) {
+				log.Printf("WARN - No statistics returned for application %v (%v).", appsinfo[i].Name, appsinfo[i].Id)
+			}
+			appsinfo[i].StatsMissing = true
+		}
+	}
+
+	// Keep the apps without metrics so a partial report can still be built
+	if firstErr != nil {
+		return appsinfo, fmt.Errorf("couldn't fetch statistics for %v of %v applications: %w", failed, len(appsinfo), firstErr)
+	}
+
+	return appsinfo, nil
+}
+
+// getAppsStatsBatch fetches the summary statistics rows of one batch of apps.
+// A batch the Controller finds too large (HTTP 413) is split in two halves,
+// down to single apps.
+func (c *Controller) getAppsStatsBatch(ctx context.Context, batch []AppDetails, startTime int64, endTime int64) ([]appStatsResponse, error) {
+
+	rows, err := c.requestAppsStats(ctx, batch, startTime, endTime)
+	if err == nil || len(batch) < 2 || !errors.Is(err, &HTTPStatusError{StatusCode: http.StatusRequestEntityTooLarge}) {
+		return rows, err
+	}
+
+	half := len(batch) / 2
+	log.Printf("WARN - Statistics request for %v applications too large, splitting it in two.", len(batch))
+
+	rows, err = c.getAppsStatsBatch(ctx, batch[:half], startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	more, err := c.getAppsStatsBatch(ctx, batch[half:], startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(rows, more...), nil
+
+}
+
+// requestAppsStats makes the summary statistics request of one batch of apps.
+func (c *Controller) requestAppsStats(ctx context.Context, batch []AppDetails, startTime int64, endTime int64) ([]appStatsResponse, error) {
 
 	var payload AppStatisticsPayload
-	var appDetailsWithMetrics []AppDetails
 	method := "POST"
 
-	// Set the base flow map URL
-	listappsurl := controllerUrl + "/controller/restui/v1/app/list/ids"
-
 	// Get timerange
 	payload.TimerangeEnd = endTime
 	payload.TimeRangeStart = startTime
@@ -306,203 +523,193 @@ func GetAllAppsSummaryStats(controllerUrl string, login []*http.Cookie, appsinfo
 	}
 
 	// Get limits
-	payload.Limit = -1
+	payload.Limit = len(batch)
 
-	for i := range appsinfo {
+	for i := range batch {
 
-		// Attach this app id to []int
-		payload.RequestFilter = append(payload.RequestFilter, int(appsinfo[i].Id))
+		// Attach this app id to []int64
+		payload.RequestFilter = append(payload.RequestFilter, batch[i].Id)
 
 	}
 
 	// Make it JSON
 	JSONpayload, _ := json.Marshal(&payload)
 
-	// strings.Reader
-	data := strings.NewReader(string(JSONpayload))
-
-	// http client
-	client := &http.Client{}
-
-	// Create HTTP request
-	req, err := http.NewRequest(method, listappsurl, data)
+	// Make the call
+	body, err := c.call(ctx, authSession, method, "/controller/restui/v1/app/list/ids", JSONpayload)
 	if err != nil {
-		return err, appDetailsWithMetrics
-	}
-
-	// Add the login cookies and headers to request
-	for i := range login {
-
-		// Add the login cookies to request
-		req.AddCookie(login[i])
-
-		// Add the X-CSRF-TOKEN as a request header
-		if login[i].Name == "X-CSRF-TOKEN" {
-			req.Header.Add(login[i].Name, login[i].Value)
-		}
-
+		return nil, err
 	}
 
-	// More headers
-	req.Header.Add("Content-Type", "application/json;charset=UTF-8")
-	req.Header.Add("Accept", "application/json, text/plain, */*")
-
-	// Make the call
-	res, err := client.Do(req)
-	if err != nil || res.StatusCode != 200 {
-
-		err := errors.New(fmt.Sprint(err) + fmt.Sprint(res))
-		return err, appDetailsWithMetrics
+	// Typed response
+	var allstats appListResponse
 
+	// JSON
+	if err := decodeJSON(c.URL+"/controller/restui/v1/app/list/ids", body, &allstats); err != nil {
+		return nil, err
 	}
 
-	// Close stream
-	defer res.Body.Close()
+	return allstats.Data, nil
 
-	// empty map
-	var allstats map[string]interface{}
+}
 
-	// response body to byte
-	body, err := ioutil.ReadAll(res.Body)
+// GetHealthRules fetches the health rules of every given application in
+// parallel and counts them by status (enabled/disabled), see
+// GetHealthRuleDetails for the detail of every rule. Applications whose
+// health rules couldn't be fetched get the failure recorded in Failures and
+// no health rules.
+func (c *Controller) GetHealthRules(ctx context.Context, appsinfo []AppDetails) ([]AppDetails, error) {
 
-	// JSON
-	json.Unmarshal(body, &allstats)
+	err := c.forEachApp(ctx, appsinfo, FetchHealthRules, c.getAppHealthRules)
 
-	// Get all apps stats
-	var appstats interface{}
-	for i := range allstats["data"].([]interface{}) {
+	return appsinfo, err
 
-		appstats = allstats["data"].([]interface{})[i]
+}
 
-		for ii := range appsinfo {
-			if appstats.(map[string]interface{})["name"].(string) == appsinfo[ii].Name {
+// getAppHealthRules fetches the health rules of a single application.
+func (c *Controller) getAppHealthRules(ctx context.Context, app *AppDetails) error {
 
-				// Number of Calls (convert from scientific notation)
-				str := fmt.Sprint(appstats.(map[string]interface{})["numberOfCalls"].(float64))
-				float, _, _ := big.ParseFloat(str, 10, 64, big.ToNearestEven)
-				noc, _ := float.Int64()
-				appsinfo[ii].Metrics.NumberOfCalls = noc
+	var rules []AppHealthRules
 
-				// Number of Errors (convert from scientific notation)
-				str = fmt.Sprint(appstats.(map[string]interface{})["numberOfErrors"].(float64))
-				float, _, _ = big.ParseFloat(str, 10, 64, big.ToNearestEven)
-				noe, _ := float.Int64()
-				appsinfo[ii].Metrics.NumberOfErrors = noe
+	// Set the HR url
+	hrurl := "/controller/alerting/rest/v1/applications/" + fmt.Sprint(app.Id) + "/health-rules"
 
-				// Average Response Time
-				appsinfo[ii].Metrics.AverageResponseTime = appstats.(map[string]interface{})["averageResponseTime"].(float64)
+	// Make the HTTP request to the Controller and decode the health rules
+	// list one rule at a time
+	err := c.stream(ctx, authToken, "GET", hrurl, nil, func(dec *json.Decoder) error {
 
-				// Calls per Minute
-				appsinfo[ii].Metrics.CallsPerMinute = appstats.(map[string]interface{})["callsPerMinute"].(float64)
+		var healthRule healthRuleSummaryResponse
+		if err := dec.Decode(&healthRule); err != nil {
+			return err
+		}
 
-				// Errors per Minute
-				appsinfo[ii].Metrics.ErrorsPerMinute = appstats.(map[string]interface{})["errorsPerMinute"].(float64)
+		rules = append(rules, AppHealthRules{
+			Name:   healthRule.Name,
+			Id:     healthRule.Id,
+			Active: healthRule.Enabled,
+		})
 
-			}
-		}
+		return nil
 
+	})
+	if err != nil {
+		return err
 	}
 
-	return nil, appsinfo
-}
+	// Only complete lists are kept, so counts are never partial
+	app.Alerting = rules
 
-func GetHealthRules(controllerUrl string, token string, appsinfo []AppDetails) (error, []AppDetails) {
+	active := 0
+	inactive := 0
+	for ii := range app.Alerting {
 
-	var jsonArrInterface []interface{}
+		if app.Alerting[ii].Active == true {
 
-	method := "GET"
+			active++
 
-	// timeout
-	timeout := time.Duration(60 * time.Second)
+		} else {
 
-	// http client
-	client := &http.Client{}
+			inactive++
+
+		}
 
-	// client
-	client = &http.Client{
-		Timeout:   timeout,
-		Transport: &http.Transport{},
 	}
+	app.Metrics.NumberOfActiveHealthRules = float64(active)
+	app.Metrics.NumberOfInactiveHealthRules = float64(inactive)
 
-	for i := range appsinfo {
+	return nil
 
-		// Set the HR url
-		hrurl := controllerUrl + "/controller/alerting/rest/v1/applications/" + fmt.Sprint(appsinfo[i].Id) + "/health-rules"
+}
 
-		// Create a new HTTP request object
-		req, err := http.NewRequest(method, hrurl, nil)
+// GetTiersAndNodes fetches the tiers and nodes of every given application in
+// parallel. Applications whose tiers or nodes couldn't be fetched get the
+// failure recorded in Failures.
+func (c *Controller) GetTiersAndNodes(ctx context.Context, appsinfo []AppDetails) ([]AppDetails, error) {
 
-		// Return error if new request creation fails
-		if err != nil {
-			log.Printf("ERROR - %v", err)
-			return err, appsinfo
-		}
+	err := c.forEachApp(ctx, appsinfo, FetchTiersAndNodes, c.getAppTiersAndNodes)
 
-		// Set HTTP headers
-		req.Header.Set("Authorization", "Bearer "+token)
+	return appsinfo, err
 
-		// Make the HTTP request to the Controller
-		res, err := client.Do(req)
+}
 
-		// If non-http error is returned from response we quit this goroutine
-		if err != nil {
-			log.Printf("ERROR - %v", err)
-			return err, appsinfo
-		}
+// getAppTiersAndNodes fetches the tiers of a single application, then its
+// nodes, and files every node under its tier.
+func (c *Controller) getAppTiersAndNodes(ctx context.Context, app *AppDetails) error {
 
-		// Close the body stream to avoid leaks later
-		defer res.Body.Close()
+	var tiers []AppTier
 
-		// Read the body into a byte var
-		body, err := ioutil.ReadAll(res.Body)
+	// Tiers
+	tiersurl := "/controller/rest/applications/" + fmt.Sprint(app.Id) + "/tiers?output=json"
 
-		// If there is an error while reading response body we quit this function
-		if err != nil {
-			log.Printf("ERROR - %v", err)
-			return err, appsinfo
-		}
+	err := c.stream(ctx, authToken, "GET", tiersurl, nil, func(dec *json.Decoder) error {
 
-		// If HTTP state from controller is bad we quit this goroutine
-		if res.StatusCode != 200 {
-			log.Printf("ERROR - Got HTTP state %v while calling %v. %v", res.StatusCode, hrurl, string(body))
-			return errors.New(fmt.Sprint(res.StatusCode)), appsinfo
+		var tier tierResponse
+		if err := dec.Decode(&tier); err != nil {
+			return err
 		}
 
-		// Unmarshal retrieved APM apps list
-		json.Unmarshal(body, &jsonArrInterface)
+		tiers = append(tiers, AppTier{
+			Name:          tier.Name,
+			Id:            tier.Id,
+			Type:          tier.Type,
+			AgentType:     tier.AgentType,
+			NumberOfNodes: tier.NumberOfNodes,
+		})
 
-		// Iterate hrs
-		for ii := range jsonArrInterface {
+		return nil
 
-			alertInfo := AppHealthRules{
-				Name:   jsonArrInterface[ii].(map[string]interface{})["name"].(string),
-				Id:     jsonArrInterface[ii].(map[string]interface{})["id"].(float64),
-				Active: jsonArrInterface[ii].(map[string]interface{})["enabled"].(bool),
-			}
-			appsinfo[i].Alerting = append(appsinfo[i].Alerting, alertInfo)
-
-		}
-
-		active := 0
-		inactive := 0
-		for ii := range appsinfo[i].Alerting {
-
-			if appsinfo[i].Alerting[ii].Active == true {
+	})
+	if err != nil {
+		return err
+	}
 
-				active++
+	// Index tiers by ID
+	byId := make(map[int64]int, len(tiers))
+	for i := range tiers {
+		byId[tiers[i].Id] = i
+	}
 
-			} else {
+	// Nodes
+	nodesurl := "/controller/rest/applications/" + fmt.Sprint(app.Id) + "/nodes?output=json"
+	nodes := 0
 
-				inactive++
+	err = c.stream(ctx, authToken, "GET", nodesurl, nil, func(dec *json.Decoder) error {
 
-			}
+		var node nodeResponse
+		if err := dec.Decode(&node); err != nil {
+			return err
+		}
 
+		i, ok := byId[node.TierId]
+		if !ok {
+			log.Printf("WARN - Node %v of application %v belongs to unknown tier %v (%v).", node.Name, app.Name, node.TierName, node.TierId)
+			return nil
 		}
-		appsinfo[i].Metrics.NumberOfActiveHealthRules = float64(active)
-		appsinfo[i].Metrics.NumberOfInactiveHealthRules = float64(inactive)
 
+		tiers[i].Nodes = append(tiers[i].Nodes, AppNode{
+			Name:                node.Name,
+			Id:                  node.Id,
+			MachineName:         node.MachineName,
+			MachineOSType:       node.MachineOSType,
+			AgentType:           node.AgentType,
+			AppAgentVersion:     node.AppAgentVersion,
+			MachineAgentVersion: node.MachineAgentVersion,
+			AppAgentPresent:     node.AppAgentPresent,
+			MachineAgentPresent: node.MachineAgentPresent,
+		})
+		nodes++
+
+		return nil
+
+	})
+	if err != nil {
+		return err
 	}
 
-	return nil, appsinfo
+	app.Tiers = tiers
+	app.Metrics.NumberOfTiers = int64(len(tiers))
+	app.Metrics.NumberOfNodes = int64(nodes)
+
+	return nil
 
 }
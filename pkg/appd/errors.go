@@ -0,0 +1,105 @@
+package appd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Sentinel errors to match the typed errors below with errors.Is.
+var (
+	ErrAuthentication = errors.New("authentication failed")
+	ErrRateLimited    = errors.New("rate limited by Controller")
+)
+
+// bodySnippetLength is how much of a response body is kept in errors.
+const bodySnippetLength = 512
+
+// AuthError is returned when the Controller rejects the API client
+// credentials (access token) or the user credentials (login).
+type AuthError struct {
+	Op  string
+	URL string
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%v failed for %v: %v", e.Op, e.URL, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthentication
+}
+
+// HTTPStatusError is returned when the Controller answers with an
+// unexpected HTTP state. Body holds the beginning of the response body.
+type HTTPStatusError struct {
+	StatusCode int
+	URL        string
+	Body       string
+}
+
+func newHTTPStatusError(req *http.Request, res *http.Response, body []byte) *HTTPStatusError {
+
+	snippet := string(body)
+	if len(snippet) > bodySnippetLength {
+		snippet = snippet[:bodySnippetLength] + "..."
+	}
+
+	return &HTTPStatusError{
+		StatusCode: res.StatusCode,
+		URL:        req.URL.String(),
+		Body:       snippet,
+	}
+
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("got HTTP state %v while calling %v: %v", e.StatusCode, e.URL, e.Body)
+}
+
+// Is matches another HTTPStatusError with the same HTTP state, so callers
+// can use errors.Is(err, &HTTPStatusError{StatusCode: 404}).
+func (e *HTTPStatusError) Is(target error) bool {
+	t, ok := target.(*HTTPStatusError)
+	return ok && t.StatusCode == e.StatusCode
+}
+
+// DecodeError is returned when a Controller response can't be decoded.
+type DecodeError struct {
+	URL string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("couldn't decode response from %v: %v", e.URL, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// RateLimitedError is returned when the Controller keeps throttling
+// requests (HTTP 429) after all retries were used up.
+type RateLimitedError struct {
+	URL        string
+	RetryAfter time.Duration
+	Err        *HTTPStatusError
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited by Controller while calling %v (retry after %v)", e.URL, e.RetryAfter)
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
@@ -2,25 +2,74 @@ package appd
 
 import (
 	"encoding/csv"
-	"fmt"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strings"
 )
 
-func GenerateCSV(profile string, controllerAppsWithDetails []AppDetails) error {
+// healthRulesExport is the health rules of one application as written by
+// GenerateHealthRulesJSON.
+type healthRulesExport struct {
+	Application string           `json:"application"`
+	Id          int64            `json:"id"`
+	Incomplete  []string         `json:"incomplete,omitempty"`
+	HealthRules []AppHealthRules `json:"healthRules"`
+}
+
+// GenerateCSV writes the given columns of every app to <profile>.csv,
+// DefaultCSVColumns when none are given.
+func GenerateCSV(profile string, controllerAppsWithDetails []AppDetails, columns []Column) error {
+
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns()
+	}
 
 	filename := profile + ".csv"
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Header
+	}
+	csvrecords := [][]string{header}
+
+	// Remove existing CSV file
+	os.Remove(filename)
+
+	for i := range controllerAppsWithDetails {
+
+		app := controllerAppsWithDetails[i]
+
+		record := make([]string, len(columns))
+		for j, column := range columns {
+			record[j] = FormatValue(column.Value(app))
+		}
+
+		csvrecords = append(csvrecords, record)
+	}
+
+	return writeCSVFile(filename, csvrecords)
+
+}
+
+// GenerateAgentComplianceCSV writes the agents out of policy found by
+// CheckAgentCompliance to <profile>-agent-compliance.csv.
+func GenerateAgentComplianceCSV(profile string, controllerAppsWithDetails []AppDetails) error {
+
+	filename := profile + "-agent-compliance.csv"
 	csvrecords := [][]string{
 		{
 			"Application Name",
 			"Controller",
-			"Number of Calls (last day)",
-			"Number of Errors (last day)",
-			"Calls per Minute (last day)",
-			"Errors per Minute (last day)",
-			"Active Alerts (health rules)",
-			"Inactive Alerts (health rules)",
-			"Alert List (name, id, enabled)"},
+			"Tier",
+			"Node",
+			"Machine",
+			"Agent Type",
+			"Agent Version",
+			"Minimum Version",
+			"Reason"},
 	}
 
 	// Remove existing CSV file
@@ -30,28 +79,102 @@ func GenerateCSV(profile string, controllerAppsWithDetails []AppDetails) error {
 
 		app := controllerAppsWithDetails[i]
 
-		csvrecords = append(csvrecords, []string{
-			app.Name,
-			profile,
-			fmt.Sprint(app.Metrics.NumberOfCalls),
-			fmt.Sprint(app.Metrics.NumberOfErrors),
-			fmt.Sprint(app.Metrics.CallsPerMinute),
-			fmt.Sprint(app.Metrics.ErrorsPerMinute),
-			fmt.Sprint(app.Metrics.NumberOfActiveHealthRules),
-			fmt.Sprint(app.Metrics.NumberOfInactiveHealthRules),
-			fmt.Sprint(app.Alerting),
-		})
+		for _, violation := range app.AgentCompliance.Violations {
+			csvrecords = append(csvrecords, []string{
+				app.Name,
+				profile,
+				violation.Tier,
+				violation.Node,
+				violation.Machine,
+				violation.AgentType,
+				violation.Version,
+				violation.MinVersion,
+				violation.Reason,
+			})
+		}
 	}
 
+	return writeCSVFile(filename, csvrecords)
+
+}
+
+// writeCSVFile writes the records to filename, ';' separated.
+func writeCSVFile(filename string, csvrecords [][]string) error {
+
 	f, e := os.Create(filename)
 	if e != nil {
 		log.Println(e)
 		return e
 	}
+	defer f.Close()
 
 	writer := csv.NewWriter(f)
 	writer.Comma = ';'
+
+	// WriteAll flushes the writer and returns writer.Error()
 	e = writer.WriteAll(csvrecords)
+	if e == nil {
+		e = f.Close()
+	}
+	if e != nil {
+		log.Println(e)
+		return e
+	}
+
+	return nil
+
+}
+
+// GenerateHealthRulesJSON writes the health rules of every application, with
+// their details (see GetHealthRuleDetails), to <profile>-health-rules.json.
+// Applications and rules are sorted by name so files from two runs can be
+// diffed. Applications whose health rules or details couldn't be fetched
+// list the failures under "incomplete".
+func GenerateHealthRulesJSON(profile string, controllerAppsWithDetails []AppDetails) error {
+
+	filename := profile + "-health-rules.json"
+
+	var export []healthRulesExport
+	for i := range controllerAppsWithDetails {
+
+		app := controllerAppsWithDetails[i]
+
+		rules := append([]AppHealthRules{}, app.Alerting...)
+		sort.SliceStable(rules, func(i, j int) bool {
+			if rules[i].Name != rules[j].Name {
+				return rules[i].Name < rules[j].Name
+			}
+			return rules[i].Id < rules[j].Id
+		})
+
+		// Flag the apps whose health rules or their details couldn't be
+		// fetched, rather than having them look changed
+		var incomplete []string
+		for _, failure := range app.Failures {
+			if strings.HasPrefix(failure, FetchHealthRules+": ") || strings.HasPrefix(failure, FetchHealthRuleDetails+": ") {
+				incomplete = append(incomplete, failure)
+			}
+		}
+
+		export = append(export, healthRulesExport{
+			Application: app.Name,
+			Id:          app.Id,
+			Incomplete:  incomplete,
+			HealthRules: rules,
+		})
+	}
+
+	sort.SliceStable(export, func(i, j int) bool {
+		return export[i].Application < export[j].Application
+	})
+
+	data, e := json.MarshalIndent(export, "", "  ")
+	if e != nil {
+		log.Println(e)
+		return e
+	}
+
+	e = ioutil.WriteFile(filename, append(data, '\n'), 0644)
 	if e != nil {
 		log.Println(e)
 		return e
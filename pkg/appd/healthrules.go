@@ -0,0 +1,243 @@
+package appd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// HealthRuleCriteria is the critical or warning part of a health rule: its
+// conditions and how they combine (ALL, ANY or a CUSTOM expression).
+type HealthRuleCriteria struct {
+	Aggregation string                `json:"aggregation"`
+	Expression  string                `json:"expression,omitempty"`
+	Conditions  []HealthRuleCondition `json:"conditions"`
+}
+
+// HealthRuleCondition is one metric condition of a health rule. Threshold
+// is a specific value, or a number of baseline units for baseline
+// comparisons.
+type HealthRuleCondition struct {
+	Name         string  `json:"name"`
+	ShortName    string  `json:"shortName"`
+	MetricPath   string  `json:"metricPath"`
+	Aggregate    string  `json:"aggregate"`
+	Comparison   string  `json:"comparison"`
+	Threshold    float64 `json:"threshold"`
+	Baseline     string  `json:"baseline,omitempty"`
+	Unit         string  `json:"unit,omitempty"`
+	TrueOnNoData bool    `json:"trueOnNoData"`
+}
+
+// comparisons spells out the Controller comparison conditions.
+var comparisons = map[string]string{
+	"GREATER_THAN_SPECIFIC_VALUE":       ">",
+	"LESS_THAN_SPECIFIC_VALUE":          "<",
+	"GREATER_THAN_OR_EQUAL_TO_SPECIFIC": ">=",
+	"LESS_THAN_OR_EQUAL_TO_SPECIFIC":    "<=",
+	"GREATER_THAN_BASELINE":             "above",
+	"LESS_THAN_BASELINE":                "below",
+	"WITHIN_BASELINE":                   "within",
+	"NOT_WITHIN_BASELINE":               "not within",
+}
+
+// String describes the condition, eg "A: Average Response Time (ms) VALUE > 500"
+// or "A: Average Response Time (ms) VALUE 3 STANDARD_DEVIATIONS above Default Baseline".
+func (c HealthRuleCondition) String() string {
+
+	comparison, ok := comparisons[c.Comparison]
+	if !ok {
+		comparison = c.Comparison
+	}
+
+	if c.Baseline != "" {
+		return fmt.Sprintf("%v: %v %v %v %v %v %v", c.ShortName, c.MetricPath, c.Aggregate, c.Threshold, c.Unit, comparison, c.Baseline)
+	}
+
+	return fmt.Sprintf("%v: %v %v %v %v", c.ShortName, c.MetricPath, c.Aggregate, comparison, c.Threshold)
+
+}
+
+// String describes the criteria, its conditions joined according to the
+// aggregation. Empty criteria are "".
+func (c *HealthRuleCriteria) String() string {
+
+	if c == nil || len(c.Conditions) == 0 {
+		return ""
+	}
+
+	var conditions []string
+	for _, condition := range c.Conditions {
+		conditions = append(conditions, condition.String())
+	}
+
+	switch c.Aggregation {
+	case "ANY":
+		return strings.Join(conditions, " OR ")
+	case "CUSTOM":
+		return c.Expression + " where " + strings.Join(conditions, "; ")
+	}
+
+	return strings.Join(conditions, " AND ")
+
+}
+
+// GetHealthRuleDetails fetches the detail of every health rule (see
+// GetHealthRules) of every given application in parallel: what it affects,
+// its schedule and its conditions. This is one call per health rule.
+// Applications whose details couldn't all be fetched get the failure
+// recorded in Failures.
+func (c *Controller) GetHealthRuleDetails(ctx context.Context, appsinfo []AppDetails) ([]AppDetails, error) {
+
+	err := c.forEachApp(ctx, appsinfo, FetchHealthRuleDetails, c.getHealthRuleDetails)
+
+	return appsinfo, err
+
+}
+
+// getHealthRuleDetails fetches the detail of every health rule of a single
+// application. The rules are only updated once all details were fetched, so
+// an app never ends up with some rules detailed and others not.
+func (c *Controller) getHealthRuleDetails(ctx context.Context, app *AppDetails) error {
+
+	rules := append([]AppHealthRules(nil), app.Alerting...)
+
+	for i := range rules {
+
+		rule := &rules[i]
+		hrurl := "/controller/alerting/rest/v1/applications/" + fmt.Sprint(app.Id) + "/health-rules/" + fmt.Sprint(rule.Id)
+
+		body, err := c.call(ctx, authToken, "GET", hrurl, nil)
+		if err != nil {
+			return err
+		}
+
+		var detail healthRuleResponse
+		if err := decodeJSON(c.URL+hrurl, body, &detail); err != nil {
+			return err
+		}
+
+		entityType, _ := detail.Affects["affectedEntityType"].(string)
+
+		rule.AffectedEntityType = entityType
+		rule.AffectsScope = describeAffects(detail.Affects)
+		rule.Schedule = detail.ScheduleName
+		rule.EvaluationMinutes = detail.UseDataFromLastNMinutes
+		rule.WaitTimeAfterViolation = detail.WaitTimeAfterViolation
+		rule.Critical = newHealthRuleCriteria(detail.EvalCriterias.CriticalCriteria)
+		rule.Warning = newHealthRuleCriteria(detail.EvalCriterias.WarningCriteria)
+
+	}
+
+	app.Alerting = rules
+
+	return nil
+
+}
+
+// newHealthRuleCriteria converts the criteria of a health rule response,
+// nil when the rule has none.
+func newHealthRuleCriteria(criteria *healthRuleCriteriaResponse) *HealthRuleCriteria {
+
+	if criteria == nil {
+		return nil
+	}
+
+	converted := &HealthRuleCriteria{
+		Aggregation: criteria.ConditionAggregationType,
+		Expression:  criteria.ConditionExpression,
+	}
+
+	for _, condition := range criteria.Conditions {
+
+		eval := condition.EvalDetail.MetricEvalDetail
+
+		comparison := eval.CompareCondition
+		if eval.MetricEvalDetailType == "BASELINE_TYPE" {
+			comparison = eval.BaselineCondition
+		}
+
+		metricPath := condition.EvalDetail.MetricPath
+		if metricPath == "" {
+			metricPath = condition.EvalDetail.MetricExpression
+		}
+
+		threshold, _ := eval.CompareValue.Float64()
+
+		converted.Conditions = append(converted.Conditions, HealthRuleCondition{
+			Name:         condition.Name,
+			ShortName:    condition.ShortName,
+			MetricPath:   metricPath,
+			Aggregate:    condition.EvalDetail.MetricAggregateFunction,
+			Comparison:   comparison,
+			Threshold:    threshold,
+			Baseline:     eval.BaselineName,
+			Unit:         eval.BaselineUnit,
+			TrueOnNoData: condition.EvaluateToTrueOnNoData,
+		})
+
+	}
+
+	return converted
+
+}
+
+// describeAffects summarises the scope of a health rule from its affects
+// section, whose layout depends on the affected entity type: every *Scope
+// and type* setting, followed by the named entities if any, eg
+// "SPECIFIC_BUSINESS_TRANSACTIONS: /search, /suggest".
+func describeAffects(affects map[string]interface{}) string {
+
+	var scopes, names []string
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+
+		switch v := v.(type) {
+
+		case map[string]interface{}:
+
+			// Same order on every run
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+
+				if s, ok := v[key].(string); ok {
+					lower := strings.ToLower(key)
+					if key != "affectedEntityType" && (strings.HasSuffix(lower, "scope") || strings.HasPrefix(lower, "typeof")) {
+						scopes = append(scopes, s)
+					}
+					continue
+				}
+
+				walk(v[key])
+
+			}
+
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					names = append(names, s)
+				} else {
+					walk(item)
+				}
+			}
+
+		}
+
+	}
+	walk(affects)
+
+	description := strings.Join(scopes, ", ")
+	if len(names) > 0 {
+		description += ": " + strings.Join(names, ", ")
+	}
+
+	return description
+
+}
@@ -0,0 +1,335 @@
+package appd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+)
+
+// Ways of reducing a metric series to a single value, see MetricSeries.Aggregate.
+const (
+	AggregateAverage = "average"
+	AggregateSum     = "sum"
+	AggregateMin     = "min"
+	AggregateMax     = "max"
+)
+
+// MetricSeries is one metric returned by the metric-data API: a single
+// point covering the whole time range with rollup, else one point per
+// Frequency (ONE_MIN, TEN_MIN, ONE_HOUR...).
+type MetricSeries struct {
+	Id        int64
+	Name      string
+	Path      string
+	Frequency string
+	Points    []MetricPoint
+}
+
+// MetricPoint is one data point of a metric. Value is the average over the
+// point, Sum the total (eg number of calls for "per minute" metrics) and
+// Count the number of observations.
+type MetricPoint struct {
+	Time        time.Time
+	Value       int64
+	Min         int64
+	Max         int64
+	Current     int64
+	Sum         int64
+	Count       int64
+	Occurrences int64
+}
+
+// CustomMetric is a metric to collect for every application, see
+// GetCustomMetrics. Path is relative to the application, eg
+// "Overall Application Performance|Average Response Time (ms)", and may use
+// * wildcards. Aggregation tells how to reduce the metric to a single value
+// (AggregateAverage by default). With Series, the time series is kept too.
+type CustomMetric struct {
+	Name        string
+	Path        string
+	Aggregation string
+	Series      bool
+}
+
+// CustomMetricValue is the value of a CustomMetric for an application.
+// Found is false when the Controller had no data for it.
+type CustomMetricValue struct {
+	Name        string
+	Path        string
+	Aggregation string
+	Value       float64
+	Found       bool
+	Series      []MetricSeries
+}
+
+// GetMetricData fetches the metrics of an application matching metricPath
+// for the given time range. Any segment of metricPath may be a * wildcard.
+// With rollup, each metric comes back with a single point covering the
+// whole range.
+func (c *Controller) GetMetricData(ctx context.Context, appId int64, metricPath string, startTime int64, endTime int64, rollup bool) ([]MetricSeries, error) {
+
+	var metrics []MetricSeries
+
+	query := url.Values{}
+	query.Set("metric-path", metricPath)
+	query.Set("time-range-type", "BETWEEN_TIMES")
+	query.Set("start-time", fmt.Sprint(startTime))
+	query.Set("end-time", fmt.Sprint(endTime))
+	query.Set("rollup", fmt.Sprint(rollup))
+	query.Set("output", "json")
+
+	mdurl := "/controller/rest/applications/" + fmt.Sprint(appId) + "/metric-data?" + query.Encode()
+
+	// Make the HTTP request to the Controller and decode one metric at a time
+	err := c.stream(ctx, authToken, "GET", mdurl, nil, func(dec *json.Decoder) error {
+
+		var metric metricDataResponse
+		if err := dec.Decode(&metric); err != nil {
+			return err
+		}
+
+		series := MetricSeries{
+			Id:        metric.MetricId,
+			Name:      metric.MetricName,
+			Path:      metric.MetricPath,
+			Frequency: metric.Frequency,
+		}
+
+		for _, v := range metric.MetricValues {
+
+			point := MetricPoint{
+				Time:        time.UnixMilli(v.StartTimeInMillis),
+				Occurrences: v.Occurrences,
+			}
+
+			// Values may come in scientific notation
+			for _, n := range []struct {
+				dst *int64
+				src json.Number
+			}{
+				{&point.Value, v.Value},
+				{&point.Min, v.Min},
+				{&point.Max, v.Max},
+				{&point.Current, v.Current},
+				{&point.Sum, v.Sum},
+				{&point.Count, v.Count},
+			} {
+				*n.dst, _ = numberToInt64(n.src)
+			}
+
+			series.Points = append(series.Points, point)
+
+		}
+
+		metrics = append(metrics, series)
+
+		return nil
+
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+
+}
+
+// Sum adds up the sums of all points. For "per minute" metrics this is the
+// total over the time range.
+func (s MetricSeries) Sum() int64 {
+
+	var sum int64
+	for _, point := range s.Points {
+		sum += point.Sum
+	}
+
+	return sum
+
+}
+
+// Average averages the values of all points, weighted by their number of
+// observations.
+func (s MetricSeries) Average() float64 {
+
+	var weighted, weights float64
+	for _, point := range s.Points {
+
+		count := float64(point.Count)
+		if count <= 0 {
+			count = 1
+		}
+		weighted += float64(point.Value) * count
+		weights += count
+
+	}
+
+	if weights == 0 {
+		return 0
+	}
+
+	return weighted / weights
+
+}
+
+// Aggregate reduces the series to a single value: AggregateAverage,
+// AggregateSum, AggregateMin or AggregateMax. ok is false for series
+// without points or unknown aggregations.
+func (s MetricSeries) Aggregate(aggregation string) (value float64, ok bool) {
+
+	if len(s.Points) == 0 {
+		return 0, false
+	}
+
+	switch aggregation {
+
+	case AggregateAverage, "":
+		return s.Average(), true
+
+	case AggregateSum:
+		return float64(s.Sum()), true
+
+	case AggregateMin:
+		value = math.Inf(1)
+		for _, point := range s.Points {
+			value = math.Min(value, float64(point.Min))
+		}
+		return value, true
+
+	case AggregateMax:
+		value = math.Inf(-1)
+		for _, point := range s.Points {
+			value = math.Max(value, float64(point.Max))
+		}
+		return value, true
+
+	}
+
+	return 0, false
+
+}
+
+// validAggregation tells if aggregation is supported by Aggregate.
+func validAggregation(aggregation string) bool {
+
+	switch aggregation {
+	case "", AggregateAverage, AggregateSum, AggregateMin, AggregateMax:
+		return true
+	}
+
+	return false
+
+}
+
+// GetCustomMetrics fetches the given custom metrics for every given
+// application in parallel, for the given time range. Metrics kept as series
+// are fetched without rollup. When a wildcard path matches several metrics
+// their values are combined: added up for sums, averaged otherwise.
+// Applications whose metrics couldn't be fetched get the failure recorded
+// in Failures.
+func (c *Controller) GetCustomMetrics(ctx context.Context, appsinfo []AppDetails, metrics []CustomMetric, startTime int64, endTime int64) ([]AppDetails, error) {
+
+	// Check the aggregations before making any call
+	for _, metric := range metrics {
+		if !validAggregation(metric.Aggregation) {
+			return appsinfo, fmt.Errorf("unsupported aggregation %q for metric %v, use average, sum, min or max", metric.Aggregation, metric.Name)
+		}
+	}
+
+	err := c.forEachApp(ctx, appsinfo, FetchCustomMetrics, func(ctx context.Context, app *AppDetails) error {
+
+		values, err := c.getAppMetrics(ctx, app.Id, metrics, startTime, endTime)
+		if err != nil {
+			return err
+		}
+
+		app.CustomMetrics = values
+
+		return nil
+
+	})
+
+	return appsinfo, err
+
+}
+
+// PerformanceSeries are the metrics fetched by GetPerformanceSeries.
+var PerformanceSeries = []CustomMetric{
+	{Name: "Calls per Minute", Path: "Overall Application Performance|Calls per Minute", Aggregation: AggregateAverage, Series: true},
+	{Name: "Average Response Time (ms)", Path: "Overall Application Performance|Average Response Time (ms)", Aggregation: AggregateAverage, Series: true},
+}
+
+// GetPerformanceSeries fetches the calls per minute and average response
+// time series (see PerformanceSeries) of every given application in
+// parallel, for the given time range. Applications whose series couldn't be
+// fetched get the failure recorded in Failures.
+func (c *Controller) GetPerformanceSeries(ctx context.Context, appsinfo []AppDetails, startTime int64, endTime int64) ([]AppDetails, error) {
+
+	err := c.forEachApp(ctx, appsinfo, FetchPerformanceSeries, func(ctx context.Context, app *AppDetails) error {
+
+		values, err := c.getAppMetrics(ctx, app.Id, PerformanceSeries, startTime, endTime)
+		if err != nil {
+			return err
+		}
+
+		app.PerformanceSeries = values
+
+		return nil
+
+	})
+
+	return appsinfo, err
+
+}
+
+// getAppMetrics fetches the given metrics of a single application.
+func (c *Controller) getAppMetrics(ctx context.Context, appId int64, metrics []CustomMetric, startTime int64, endTime int64) ([]CustomMetricValue, error) {
+
+	values := make([]CustomMetricValue, len(metrics))
+
+	for i, metric := range metrics {
+
+		values[i] = CustomMetricValue{Name: metric.Name, Path: metric.Path, Aggregation: metric.Aggregation}
+
+		series, err := c.GetMetricData(ctx, appId, metric.Path, startTime, endTime, !metric.Series)
+		if err != nil {
+			return nil, err
+		}
+
+		// Combine the matching metrics
+		var found int
+		for _, s := range series {
+
+			value, ok := s.Aggregate(metric.Aggregation)
+			if !ok {
+				continue
+			}
+
+			switch {
+			case found == 0:
+				values[i].Value = value
+			case metric.Aggregation == AggregateSum:
+				values[i].Value += value
+			case metric.Aggregation == AggregateMin:
+				values[i].Value = math.Min(values[i].Value, value)
+			case metric.Aggregation == AggregateMax:
+				values[i].Value = math.Max(values[i].Value, value)
+			default:
+				values[i].Value += (value - values[i].Value) / float64(found+1)
+			}
+			found++
+
+		}
+		values[i].Found = found > 0
+
+		if metric.Series {
+			values[i].Series = series
+		}
+
+	}
+
+	return values, nil
+
+}
@@ -0,0 +1,214 @@
+package appd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// notificationActions are the action types that notify someone, as opposed
+// to diagnostic or remediation actions.
+var notificationActions = map[string]bool{
+	"EMAIL":        true,
+	"CUSTOM_EMAIL": true,
+	"SMS":          true,
+	"HTTP_REQUEST": true,
+	"CUSTOM":       true,
+}
+
+type AppPolicy struct {
+	Name    string
+	Id      int64
+	Enabled bool
+
+	// Health rules triggering the policy: all of them, or the named ones
+	AllHealthRules bool
+	HealthRules    []string
+
+	Actions []AppAction
+}
+type AppAction struct {
+	Name string
+	Id   int64
+	Type string
+}
+
+// Notifies tells if the action notifies someone (email, SMS, HTTP request,
+// custom action).
+func (a AppAction) Notifies() bool {
+	return notificationActions[a.Type]
+}
+
+// GetPolicies fetches the policies and actions of every given application in
+// parallel, and checks which health rules (see GetHealthRules) are covered by
+// an enabled policy. Enabled health rules covered by none are flagged as
+// Orphaned, and apps get NotificationPath set when at least one enabled
+// policy triggered by health rules notifies someone. Applications whose
+// policies or actions couldn't be fetched get the failure recorded in
+// Failures.
+func (c *Controller) GetPolicies(ctx context.Context, appsinfo []AppDetails) ([]AppDetails, error) {
+
+	err := c.forEachApp(ctx, appsinfo, FetchPolicies, c.getAppPolicies)
+
+	return appsinfo, err
+
+}
+
+// getAppPolicies fetches the actions and policies of a single application,
+// then the details of every policy.
+func (c *Controller) getAppPolicies(ctx context.Context, app *AppDetails) error {
+
+	var (
+		actions  []AppAction
+		policies []AppPolicy
+	)
+
+	// Actions
+	acturl := "/controller/alerting/rest/v1/applications/" + fmt.Sprint(app.Id) + "/actions"
+
+	err := c.stream(ctx, authToken, "GET", acturl, nil, func(dec *json.Decoder) error {
+
+		var action actionResponse
+		if err := dec.Decode(&action); err != nil {
+			return err
+		}
+
+		actions = append(actions, AppAction{
+			Name: action.Name,
+			Id:   action.Id,
+			Type: action.ActionType,
+		})
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	// Policies
+	polurl := "/controller/alerting/rest/v1/applications/" + fmt.Sprint(app.Id) + "/policies"
+
+	err = c.stream(ctx, authToken, "GET", polurl, nil, func(dec *json.Decoder) error {
+
+		var policy policySummaryResponse
+		if err := dec.Decode(&policy); err != nil {
+			return err
+		}
+
+		policies = append(policies, AppPolicy{
+			Name:    policy.Name,
+			Id:      policy.Id,
+			Enabled: policy.Enabled,
+		})
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	// Health rules and actions of every policy
+	for i := range policies {
+
+		body, err := c.call(ctx, authToken, "GET", polurl+"/"+fmt.Sprint(policies[i].Id), nil)
+		if err != nil {
+			return err
+		}
+
+		var policy policyResponse
+		if err := decodeJSON(c.URL+polurl+"/"+fmt.Sprint(policies[i].Id), body, &policy); err != nil {
+			return err
+		}
+
+		// Policies may be triggered by other events only
+		if hr := policy.Events.HealthRuleEvents; hr != nil {
+			policies[i].AllHealthRules = hr.HealthRuleScope.HealthRuleScopeType == "ALL_HEALTH_RULES"
+			policies[i].HealthRules = hr.HealthRuleScope.HealthRules
+		}
+
+		for _, action := range policy.Actions {
+			policies[i].Actions = append(policies[i].Actions, AppAction{
+				Name: action.ActionName,
+				Type: action.ActionType,
+			})
+		}
+
+	}
+
+	app.Actions = actions
+	app.Policies = policies
+
+	checkAlertingCoverage(app)
+
+	return nil
+
+}
+
+// checkAlertingCoverage finds the enabled policies covering every health
+// rule of the app, flags the orphaned ones and tells if the app has a
+// notification path.
+func checkAlertingCoverage(app *AppDetails) {
+
+	app.NotificationPath = false
+	app.Metrics.NumberOfOrphanedHealthRules = 0
+
+	for i := range app.Alerting {
+
+		rule := &app.Alerting[i]
+		rule.Policies = nil
+
+		for _, policy := range app.Policies {
+
+			if !policy.Enabled || !policy.covers(rule.Name) {
+				continue
+			}
+
+			rule.Policies = append(rule.Policies, policy.Name)
+
+			// A notification path is an enabled rule routed to someone
+			if rule.Active && policy.notifies() {
+				app.NotificationPath = true
+			}
+
+		}
+
+		rule.Orphaned = rule.Active && len(rule.Policies) == 0
+		if rule.Orphaned {
+			app.Metrics.NumberOfOrphanedHealthRules++
+		}
+
+	}
+
+}
+
+// covers tells if the policy is triggered by the named health rule.
+func (p AppPolicy) covers(rule string) bool {
+
+	if p.AllHealthRules {
+		return true
+	}
+
+	for _, name := range p.HealthRules {
+		if name == rule {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// notifies tells if any action of the policy notifies someone.
+func (p AppPolicy) notifies() bool {
+
+	for _, action := range p.Actions {
+		if action.Notifies() {
+			return true
+		}
+	}
+
+	return false
+
+}
@@ -0,0 +1,120 @@
+package appd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// defaultConcurrency is the number of workers used for per-app calls
+// when none is configured.
+const defaultConcurrency = 4
+
+// What is fetched per app, as recorded in AppDetails.Failures, see Failed.
+const (
+	FetchStatistics           = "statistics"
+	FetchHealthRules          = "health rules"
+	FetchHealthRuleDetails    = "health rule details"
+	FetchTiersAndNodes        = "tiers and nodes"
+	FetchBusinessTransactions = "business transactions"
+	FetchBackends             = "backends"
+	FetchViolations           = "health rule violations"
+	FetchPolicies             = "policies and actions"
+	FetchCustomMetrics        = "custom metrics"
+	FetchPerformanceSeries    = "performance series"
+)
+
+// Failed tells if fetching what (one of the Fetch constants) failed for the
+// app, in which case the values coming from it are missing or partial.
+func (app AppDetails) Failed(what string) bool {
+
+	for _, failure := range app.Failures {
+		if strings.HasPrefix(failure, what+": ") {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// forEachApp runs fn for every application through a pool of at most
+// Concurrency workers. Each call only touches its own app, so results end up
+// in the same order as the input. A failing app doesn't stop the others: the
+// failure is recorded on the app and a summary error is returned at the end.
+// Once ctx is done no new apps are started and ctx.Err() is returned.
+func (c *Controller) forEachApp(ctx context.Context, apps []AppDetails, what string, fn func(ctx context.Context, app *AppDetails) error) error {
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+
+	// Feed app indexes to the workers
+	jobs := make(chan int)
+
+	workers := c.Concurrency
+	if workers > len(apps) {
+		workers = len(apps)
+	}
+
+	for w := 0; w < workers; w++ {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			for i := range jobs {
+
+				app := &apps[i]
+
+				// Record the failure on the app and carry on
+				if err := fn(ctx, app); err != nil {
+
+					log.Printf("ERROR - Couldn't fetch %v for application %v (%v): %v", what, app.Name, app.Id, err)
+					app.Failures = append(app.Failures, fmt.Sprintf("%v: %v", what, err))
+
+					mu.Lock()
+					failed++
+					mu.Unlock()
+
+				}
+
+			}
+
+		}()
+
+	}
+
+	// Stop handing out apps once cancelled
+	for i := range apps {
+
+		select {
+		case jobs <- i:
+			continue
+		case <-ctx.Done():
+		}
+
+		break
+
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("couldn't fetch %v for %v of %v applications", what, failed, len(apps))
+	}
+
+	return nil
+
+}
@@ -0,0 +1,59 @@
+package appd
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter spaces out requests so that no more than the configured
+// number of requests per second is sent. It is safe for concurrent use.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rps requests per second.
+// A nil limiter (rps <= 0) doesn't limit anything.
+func NewRateLimiter(rps float64) *RateLimiter {
+
+	if rps <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{
+		interval: time.Duration(float64(time.Second) / rps),
+	}
+
+}
+
+// Wait blocks until the next request is allowed or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+
+	if l == nil {
+		return ctx.Err()
+	}
+
+	// Reserve the next slot
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	slot := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	// Wait for our slot
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+}
@@ -0,0 +1,297 @@
+package appd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// redacted replaces secrets in recorded traffic.
+const redacted = "REDACTED"
+
+// Exchange is one Controller request/response pair as saved by the
+// recorder. Secrets, tokens and cookies are redacted.
+type Exchange struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is the request half of an Exchange. URL has no host.
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// RecordedResponse is the response half of an Exchange.
+type RecordedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// recordingTransport saves every request/response pair going through it.
+type recordingTransport struct {
+	dir  string
+	next http.RoundTripper
+
+	mu  sync.Mutex
+	seq map[string]int
+}
+
+// replayTransport serves recorded responses instead of calling the Controller.
+type replayTransport struct {
+	dir string
+
+	mu  sync.Mutex
+	seq map[string]int
+}
+
+// newRecordingTransport returns a transport saving all traffic of next to dir.
+func newRecordingTransport(dir string, next http.RoundTripper) (*recordingTransport, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &recordingTransport{dir: dir, next: next, seq: map[string]int{}}, nil
+
+}
+
+// newReplayTransport returns a transport serving the traffic recorded in dir.
+func newReplayTransport(dir string) (*replayTransport, error) {
+
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	return &replayTransport{dir: dir, seq: map[string]int{}}, nil
+
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// Keep a copy of the request body and hand a fresh one to the transport
+	reqBody, req, err := drainRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep a copy of the response body and hand a fresh one to the caller
+	resBody, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+
+	exchange := Exchange{
+		Request: RecordedRequest{
+			Method: req.Method,
+			URL:    req.URL.RequestURI(),
+			Header: redactHeader(req.Header, "Authorization", "Cookie", "X-Csrf-Token"),
+			Body:   redactRequestBody(reqBody),
+		},
+		Response: RecordedResponse{
+			StatusCode: res.StatusCode,
+			Header:     redactSetCookies(res.Header),
+			Body:       redactResponseBody(resBody),
+		},
+	}
+
+	// The body may change size once redacted
+	exchange.Response.Header.Del("Content-Length")
+
+	// Number repeated calls of the same request
+	key := exchangeKey(req.Method, exchange.Request.URL, exchange.Request.Body)
+
+	t.mu.Lock()
+	t.seq[key]++
+	n := t.seq[key]
+	t.mu.Unlock()
+
+	data, err := json.MarshalIndent(exchange, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(t.dir, fmt.Sprintf("%v-%v.json", key, n)), data, 0644); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	reqBody, req, err := drainRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := exchangeKey(req.Method, req.URL.RequestURI(), redactRequestBody(reqBody))
+
+	// Serve repeated calls in recorded order, repeating the last response
+	// once they run out
+	t.mu.Lock()
+	n := t.seq[key] + 1
+	data, err := ioutil.ReadFile(filepath.Join(t.dir, fmt.Sprintf("%v-%v.json", key, n)))
+	if err == nil {
+		t.seq[key] = n
+	} else if n > 1 {
+		data, err = ioutil.ReadFile(filepath.Join(t.dir, fmt.Sprintf("%v-%v.json", key, n-1)))
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("no recorded response for %v %v in %v", req.Method, req.URL.RequestURI(), t.dir)
+	}
+
+	var exchange Exchange
+	if err := json.Unmarshal(data, &exchange); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%v %v", exchange.Response.StatusCode, http.StatusText(exchange.Response.StatusCode)),
+		StatusCode:    exchange.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        exchange.Response.Header,
+		Body:          ioutil.NopCloser(strings.NewReader(exchange.Response.Body)),
+		ContentLength: int64(len(exchange.Response.Body)),
+		Request:       req,
+	}, nil
+
+}
+
+// drainRequestBody reads the request body and returns it along with a copy
+// of the request carrying an unread body.
+func drainRequestBody(req *http.Request) ([]byte, *http.Request, error) {
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, req, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clone := req.Clone(req.Context())
+	clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, clone, nil
+
+}
+
+// exchangeKey identifies a request in a recording: readable path plus a hash
+// of the method, path, query and (redacted) body.
+func exchangeKey(method string, uri string, body string) string {
+
+	sum := sha1.Sum([]byte(method + " " + uri + "\n" + body))
+
+	path := strings.SplitN(uri, "?", 2)[0]
+	name := strings.Trim(strings.NewReplacer("/", "_", "{", "", "}", "").Replace(path), "_")
+	if len(name) > 100 {
+		name = name[:100]
+	}
+
+	return strings.ToLower(method) + "_" + name + "-" + hex.EncodeToString(sum[:])[:10]
+
+}
+
+// redactHeader returns a copy of header with the given headers redacted.
+func redactHeader(header http.Header, names ...string) http.Header {
+
+	clean := header.Clone()
+
+	for _, name := range names {
+		if clean.Get(name) != "" {
+			clean.Set(name, redacted)
+		}
+	}
+
+	return clean
+
+}
+
+// redactSetCookies returns a copy of header with cookie values redacted,
+// keeping cookie names and attributes.
+func redactSetCookies(header http.Header) http.Header {
+
+	clean := header.Clone()
+
+	for i, cookie := range clean.Values("Set-Cookie") {
+
+		name := strings.SplitN(cookie, "=", 2)[0]
+		attrs := ""
+		if semi := strings.Index(cookie, ";"); semi >= 0 {
+			attrs = cookie[semi:]
+		}
+
+		clean["Set-Cookie"][i] = name + "=" + redacted + attrs
+
+	}
+
+	return clean
+
+}
+
+// redactRequestBody removes the API client name and secret from access token
+// requests, so recordings replay whatever credentials are configured.
+func redactRequestBody(body []byte) string {
+
+	if !bytes.Contains(body, []byte("client_secret=")) {
+		return string(body)
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return redacted
+	}
+
+	form.Set("client_id", redacted)
+	form.Set("client_secret", redacted)
+
+	return form.Encode()
+
+}
+
+// redactResponseBody removes access tokens from responses.
+func redactResponseBody(body []byte) string {
+
+	if !bytes.Contains(body, []byte(`"access_token"`)) {
+		return string(body)
+	}
+
+	var token map[string]interface{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return redacted
+	}
+
+	token["access_token"] = redacted
+
+	clean, _ := json.Marshal(token)
+
+	return string(clean)
+
+}
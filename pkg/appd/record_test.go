@@ -0,0 +1,130 @@
+package appd_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/sivanovie/appd-stats/pkg/appd/appdtest"
+)
+
+// record runs a few calls against the mock Controller, the second
+// applications list being malformed, and returns the recording directory
+// and the secrets that went over the wire.
+func record(t *testing.T) (string, []string) {
+
+	t.Helper()
+
+	server := appdtest.NewServer()
+	defer server.Close()
+
+	dir := t.TempDir()
+
+	conf := server.Config()
+	conf.RecordDir = dir
+
+	ctrl, err := appd.NewController(conf)
+	if err != nil {
+		t.Fatalf("NewController: %v", err)
+	}
+
+	ctx := context.Background()
+
+	token, err := ctrl.GetAccessToken(ctx)
+	if err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+	cookies, err := ctrl.GetLoginCookies(ctx)
+	if err != nil {
+		t.Fatalf("GetLoginCookies: %v", err)
+	}
+
+	if _, err := ctrl.GetApplications(ctx); err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+	server.Fail(applicationsPath, appdtest.MalformedJSON)
+	if _, err := ctrl.GetApplications(ctx); err == nil {
+		t.Fatal("GetApplications succeeded on a malformed response")
+	}
+
+	secrets := []string{"client_secret=" + appdtest.Secret, appdtest.Auth, appdtest.User + ":" + appdtest.Pass, appdtest.Client + "@" + appdtest.Account, token}
+	for _, cookie := range cookies {
+		secrets = append(secrets, cookie.Value)
+	}
+
+	return dir, secrets
+
+}
+
+func TestRecordingIsRedacted(t *testing.T) {
+
+	dir, secrets := record(t)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no recorded exchanges in %v (%v)", dir, err)
+	}
+
+	var all strings.Builder
+	for _, file := range files {
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all.Write(data)
+
+	}
+
+	for _, secret := range secrets {
+		if secret != "" && strings.Contains(all.String(), secret) {
+			t.Errorf("recording contains secret %q", secret)
+		}
+	}
+
+	// Redacted, not dropped
+	for _, want := range []string{`"Authorization": [`, `"Set-Cookie": [`, "client_id=REDACTED", "client_secret=REDACTED", `\"access_token\":\"REDACTED\"`} {
+		if !strings.Contains(all.String(), want) {
+			t.Errorf("recording has no %v", want)
+		}
+	}
+
+}
+
+func TestReplay(t *testing.T) {
+
+	dir, _ := record(t)
+
+	// No Controller and no credentials
+	ctrl, err := appd.NewController(appd.ControllerConfig{Name: "replay", URL: "http://controller.invalid", ReplayDir: dir})
+	if err != nil {
+		t.Fatalf("NewController: %v", err)
+	}
+
+	ctx := context.Background()
+
+	if _, err := ctrl.GetAccessToken(ctx); err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+
+	// Repeated calls replay in recorded order, then repeat the last one
+	apps, err := ctrl.GetApplications(ctx)
+	if err != nil {
+		t.Fatalf("GetApplications: %v", err)
+	}
+	if len(apps) != 6 {
+		t.Errorf("got %v applications, want 6", len(apps))
+	}
+
+	for i := 0; i < 2; i++ {
+		var decodeErr *appd.DecodeError
+		if _, err := ctrl.GetApplications(ctx); !errors.As(err, &decodeErr) {
+			t.Errorf("replayed GetApplications error = %v, want the recorded malformed response", err)
+		}
+	}
+
+}
@@ -0,0 +1,394 @@
+package appd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+)
+
+// maxLoggedPayload caps how much of a payload is logged on decode failures.
+const maxLoggedPayload = 4096
+
+// accessTokenResponse is returned by /api/oauth/access_token.
+type accessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// applicationResponse is one application returned by /controller/rest/applications.
+type applicationResponse struct {
+	Id          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// appListResponse is returned by /controller/restui/v1/app/list/ids.
+type appListResponse struct {
+	Data []appStatsResponse `json:"data"`
+}
+
+// appStatsResponse is the summary statistics row of one application.
+// Apps without traffic in the time range come back with null metrics, which
+// decode as zero. Counts may be written in scientific notation (eg 1.2345E7)
+// so they are decoded as json.Number.
+type appStatsResponse struct {
+	Id                  int64       `json:"id"`
+	Name                string      `json:"name"`
+	NumberOfCalls       json.Number `json:"numberOfCalls"`
+	NumberOfErrors      json.Number `json:"numberOfErrors"`
+	AverageResponseTime float64     `json:"averageResponseTime"`
+	CallsPerMinute      float64     `json:"callsPerMinute"`
+	ErrorsPerMinute     float64     `json:"errorsPerMinute"`
+}
+
+// healthRuleSummaryResponse is one health rule returned by
+// /controller/alerting/rest/v1/applications/{id}/health-rules.
+type healthRuleSummaryResponse struct {
+	Id      int64  `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// healthRuleResponse is returned by
+// /controller/alerting/rest/v1/applications/{app}/health-rules/{id}. The
+// layout of affects depends on the affected entity type so it is kept raw.
+type healthRuleResponse struct {
+	Id                      int64                  `json:"id"`
+	Name                    string                 `json:"name"`
+	Enabled                 bool                   `json:"enabled"`
+	UseDataFromLastNMinutes int                    `json:"useDataFromLastNMinutes"`
+	WaitTimeAfterViolation  int                    `json:"waitTimeAfterViolation"`
+	ScheduleName            string                 `json:"scheduleName"`
+	Affects                 map[string]interface{} `json:"affects"`
+	EvalCriterias           struct {
+		CriticalCriteria *healthRuleCriteriaResponse `json:"criticalCriteria"`
+		WarningCriteria  *healthRuleCriteriaResponse `json:"warningCriteria"`
+	} `json:"evalCriterias"`
+}
+
+// healthRuleCriteriaResponse is the critical or warning part of a health rule.
+type healthRuleCriteriaResponse struct {
+	ConditionAggregationType string `json:"conditionAggregationType"`
+	ConditionExpression      string `json:"conditionExpression"`
+	Conditions               []struct {
+		Name                   string `json:"name"`
+		ShortName              string `json:"shortName"`
+		EvaluateToTrueOnNoData bool   `json:"evaluateToTrueOnNoData"`
+		EvalDetail             struct {
+			EvalDetailType          string `json:"evalDetailType"`
+			MetricAggregateFunction string `json:"metricAggregateFunction"`
+			MetricPath              string `json:"metricPath"`
+			MetricExpression        string `json:"metricExpression"`
+			MetricEvalDetail        struct {
+				MetricEvalDetailType string      `json:"metricEvalDetailType"`
+				CompareCondition     string      `json:"compareCondition"`
+				BaselineCondition    string      `json:"baselineCondition"`
+				BaselineName         string      `json:"baselineName"`
+				BaselineUnit         string      `json:"baselineUnit"`
+				CompareValue         json.Number `json:"compareValue"`
+			} `json:"metricEvalDetail"`
+		} `json:"evalDetail"`
+	} `json:"conditions"`
+}
+
+// actionResponse is one action returned by
+// /controller/alerting/rest/v1/applications/{app}/actions.
+type actionResponse struct {
+	Id         int64  `json:"id"`
+	Name       string `json:"name"`
+	ActionType string `json:"actionType"`
+}
+
+// policySummaryResponse is one policy returned by
+// /controller/alerting/rest/v1/applications/{app}/policies.
+type policySummaryResponse struct {
+	Id      int64  `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// policyResponse is returned by
+// /controller/alerting/rest/v1/applications/{app}/policies/{id}.
+// HealthRuleEvents is null for policies triggered by other events only.
+type policyResponse struct {
+	Id      int64  `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Actions []struct {
+		ActionName string `json:"actionName"`
+		ActionType string `json:"actionType"`
+	} `json:"actions"`
+	Events struct {
+		HealthRuleEvents *struct {
+			HealthRuleScope struct {
+				HealthRuleScopeType string   `json:"healthRuleScopeType"`
+				HealthRules         []string `json:"healthRules"`
+			} `json:"healthRuleScope"`
+		} `json:"healthRuleEvents"`
+	} `json:"events"`
+}
+
+// tierResponse is one tier returned by /controller/rest/applications/{app}/tiers.
+type tierResponse struct {
+	Id            int64  `json:"id"`
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	AgentType     string `json:"agentType"`
+	NumberOfNodes int    `json:"numberOfNodes"`
+}
+
+// nodeResponse is one node returned by /controller/rest/applications/{app}/nodes.
+type nodeResponse struct {
+	Id                  int64  `json:"id"`
+	Name                string `json:"name"`
+	TierId              int64  `json:"tierId"`
+	TierName            string `json:"tierName"`
+	MachineName         string `json:"machineName"`
+	MachineOSType       string `json:"machineOSType"`
+	AgentType           string `json:"agentType"`
+	AppAgentPresent     bool   `json:"appAgentPresent"`
+	AppAgentVersion     string `json:"appAgentVersion"`
+	MachineAgentPresent bool   `json:"machineAgentPresent"`
+	MachineAgentVersion string `json:"machineAgentVersion"`
+}
+
+// businessTransactionResponse is one business transaction returned by
+// /controller/rest/applications/{app}/business-transactions.
+type businessTransactionResponse struct {
+	Id             int64  `json:"id"`
+	Name           string `json:"name"`
+	EntryPointType string `json:"entryPointType"`
+	TierId         int64  `json:"tierId"`
+	TierName       string `json:"tierName"`
+	Background     bool   `json:"background"`
+}
+
+// backendResponse is one backend returned by
+// /controller/rest/applications/{app}/backends.
+type backendResponse struct {
+	Id            int64  `json:"id"`
+	Name          string `json:"name"`
+	ExitPointType string `json:"exitPointType"`
+	TierId        int64  `json:"tierId"`
+}
+
+// healthRuleViolationResponse is one violation returned by
+// /controller/rest/applications/{app}/problems/healthrule-violations.
+// EndTimeInMillis is 0 while the violation is open.
+type healthRuleViolationResponse struct {
+	Id                       int64            `json:"id"`
+	Name                     string           `json:"name"`
+	Severity                 string           `json:"severity"`
+	IncidentStatus           string           `json:"incidentStatus"`
+	StartTimeInMillis        int64            `json:"startTimeInMillis"`
+	EndTimeInMillis          int64            `json:"endTimeInMillis"`
+	AffectedEntityDefinition entityDefinition `json:"affectedEntityDefinition"`
+}
+
+// entityDefinition identifies the entity (tier, node, business transaction...)
+// an event is about.
+type entityDefinition struct {
+	EntityType string `json:"entityType"`
+	EntityId   int64  `json:"entityId"`
+	Name       string `json:"name"`
+}
+
+// metricDataResponse is one metric returned by
+// /controller/rest/applications/{app}/metric-data.
+type metricDataResponse struct {
+	MetricId     int64                 `json:"metricId"`
+	MetricName   string                `json:"metricName"`
+	MetricPath   string                `json:"metricPath"`
+	Frequency    string                `json:"frequency"`
+	MetricValues []metricValueResponse `json:"metricValues"`
+}
+
+// metricValueResponse is one data point of a metric. Values may be written
+// in scientific notation so they are decoded as json.Number.
+type metricValueResponse struct {
+	StartTimeInMillis int64       `json:"startTimeInMillis"`
+	Occurrences       int64       `json:"occurrences"`
+	Current           json.Number `json:"current"`
+	Min               json.Number `json:"min"`
+	Max               json.Number `json:"max"`
+	Count             json.Number `json:"count"`
+	Sum               json.Number `json:"sum"`
+	Value             json.Number `json:"value"`
+}
+
+// decodeJSON unmarshals a Controller response into v. On failure the raw
+// payload is logged and a DecodeError is returned.
+func decodeJSON(url string, body []byte, v interface{}) error {
+
+	err := json.Unmarshal(body, v)
+	if err == nil {
+		return nil
+	}
+
+	payload := string(body)
+	if len(payload) > maxLoggedPayload {
+		payload = payload[:maxLoggedPayload] + "..."
+	}
+
+	log.Printf("ERROR - Couldn't decode response from %v: %v. Payload: %v", url, err, payload)
+
+	return &DecodeError{URL: url, Err: err}
+
+}
+
+// decodeJSONArray decodes a JSON array from r one element at a time, calling
+// each with the decoder positioned on the next element. When the payload
+// isn't valid JSON, the bytes around the failing position are logged and a
+// DecodeError is returned. Other errors, such as a broken connection or a
+// cancelled context, are returned as they are.
+func decodeJSONArray(url string, r io.Reader, each func(dec *json.Decoder) error) error {
+
+	// Keep the tail of the stream to log it on failure
+	tail := &tailReader{r: r, max: 2 * maxLoggedPayload}
+	dec := json.NewDecoder(tail)
+
+	fail := func(err error) error {
+
+		// The stream itself failed, eg the connection dropped halfway
+		if tail.err != nil || !isJSONError(err) {
+			return err
+		}
+
+		offset := dec.InputOffset()
+		log.Printf("ERROR - Couldn't decode response from %v at offset %v: %v. Payload around offset: %v", url, offset, err, tail.around(offset, maxLoggedPayload))
+
+		return &DecodeError{URL: url, Err: err}
+
+	}
+
+	// Opening bracket
+	tok, err := dec.Token()
+	if err != nil {
+		return fail(err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fail(&notArrayError{tok})
+	}
+
+	// Elements
+	for dec.More() {
+		if err := each(dec); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Closing bracket
+	if _, err := dec.Token(); err != nil {
+		return fail(err)
+	}
+
+	return nil
+
+}
+
+// notArrayError is returned by decodeJSONArray when the payload isn't an array.
+type notArrayError struct {
+	Token json.Token
+}
+
+func (e *notArrayError) Error() string {
+	return fmt.Sprintf("expected a JSON array, got %v", e.Token)
+}
+
+// isJSONError tells if err comes from an invalid or unexpected payload
+// rather than from reading it.
+func isJSONError(err error) bool {
+
+	var (
+		syntaxErr   *json.SyntaxError
+		typeErr     *json.UnmarshalTypeError
+		notArrayErr *notArrayError
+	)
+
+	// Empty or truncated payloads are reported as EOF by the decoder, when
+	// the stream ended cleanly
+	return errors.As(err, &syntaxErr) ||
+		errors.As(err, &typeErr) ||
+		errors.As(err, &notArrayErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+
+}
+
+// tailReader reads from r and keeps the last max bytes read, so the part of
+// a stream a decoder failed on can be logged. err is the first error of r
+// other than io.EOF.
+type tailReader struct {
+	r    io.Reader
+	max  int
+	buf  []byte
+	read int64
+	err  error
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+
+	n, err := t.r.Read(p)
+
+	t.buf = append(t.buf, p[:n]...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	t.read += int64(n)
+
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+
+	return n, err
+
+}
+
+// around returns up to n bytes of the stream centred on offset, as far as
+// they were kept.
+func (t *tailReader) around(offset int64, n int) string {
+
+	// Offset of the first byte kept
+	first := t.read - int64(len(t.buf))
+
+	from := offset - int64(n/2) - first
+	if from < 0 {
+		from = 0
+	}
+	to := offset + int64(n/2) - first
+	if to > int64(len(t.buf)) {
+		to = int64(len(t.buf))
+	}
+	if from >= to {
+		return ""
+	}
+
+	return string(t.buf[from:to])
+
+}
+
+// numberToInt64 converts a JSON number that may be written in scientific
+// notation to int64. Missing or null numbers are 0.
+func numberToInt64(n json.Number) (int64, error) {
+
+	if n == "" {
+		return 0, nil
+	}
+
+	// Plain integer
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+
+	// Scientific notation or decimals
+	f, err := n.Float64()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(math.Round(f)), nil
+
+}
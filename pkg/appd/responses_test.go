@@ -0,0 +1,56 @@
+package appd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecodeJSONArray(t *testing.T) {
+
+	dropped := errors.New("connection reset by peer")
+
+	for _, test := range []struct {
+		name    string
+		r       io.Reader
+		decode  bool
+		wantErr error
+	}{
+		{"valid", strings.NewReader(`[{"id": 1}, {"id": 2}]`), false, nil},
+		{"empty", strings.NewReader(``), true, io.EOF},
+		{"truncated", strings.NewReader(`[{"id": 1}, {"id"`), true, io.ErrUnexpectedEOF},
+		{"not an array", strings.NewReader(`{"id": 1}`), true, nil},
+		{"wrong type", strings.NewReader(`[{"id": "one"}]`), true, nil},
+		{"dropped", io.MultiReader(strings.NewReader(`[{"id": 1}, {"id"`), iotest.ErrReader(dropped)), false, dropped},
+		{"dropped unexpectedly", io.MultiReader(strings.NewReader(`[{"id": 1}`), iotest.ErrReader(io.ErrUnexpectedEOF)), false, io.ErrUnexpectedEOF},
+	} {
+
+		var ids []int64
+		err := decodeJSONArray("http://controller/list", test.r, func(dec *json.Decoder) error {
+			var v struct {
+				Id int64 `json:"id"`
+			}
+			if err := dec.Decode(&v); err != nil {
+				return err
+			}
+			ids = append(ids, v.Id)
+			return nil
+		})
+
+		var decodeErr *DecodeError
+		if isDecode := errors.As(err, &decodeErr); isDecode != test.decode {
+			t.Errorf("%v: got error %v, want a DecodeError: %v", test.name, err, test.decode)
+		}
+		if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+			t.Errorf("%v: got error %v, want %v", test.name, err, test.wantErr)
+		}
+		if test.name == "valid" && (err != nil || len(ids) != 2) {
+			t.Errorf("%v: got %v, %v, want 2 ids", test.name, ids, err)
+		}
+
+	}
+
+}
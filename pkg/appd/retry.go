@@ -0,0 +1,111 @@
+package appd
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how failed Controller calls are retried.
+// Transient failures (HTTP 429/5xx, timeouts, connection resets) are retried
+// with exponential backoff and full jitter, honoring Retry-After on 429/503.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is used when no retry policy is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   1 * time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// jitter source shared by all clients
+var (
+	jitterMu  sync.Mutex
+	jitterRnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns the delay before the given retry attempt (1 = first retry).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+
+	// Exponential backoff capped at MaxDelay
+	delay := p.BaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	// Full jitter
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+
+	return time.Duration(jitterRnd.Int63n(int64(delay) + 1))
+
+}
+
+// retryable tells if a response or transport error is worth retrying.
+func retryable(res *http.Response, err error) bool {
+
+	if err != nil {
+
+		// Timeouts
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+
+		// Connection resets and dropped connections
+		return errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF)
+
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+
+}
+
+// retryAfter returns the delay requested by the Controller via the
+// Retry-After header on 429/503 responses, or 0 if there is none.
+func retryAfter(res *http.Response) time.Duration {
+
+	if res == nil || (res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable) {
+		return 0
+	}
+
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	// Delay in seconds
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	// HTTP date
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+
+}
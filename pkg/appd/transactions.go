@@ -0,0 +1,139 @@
+package appd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// businessTransactionMetrics is the metric path of all the business
+// transaction metrics of an application: tier|business transaction|metric.
+const businessTransactionMetrics = "Business Transaction Performance|Business Transactions|*|*|*"
+
+type AppBusinessTransaction struct {
+	Name           string
+	Id             int64
+	TierName       string
+	EntryPointType string
+	Metrics        BusinessTransactionMetrics
+}
+type BusinessTransactionMetrics struct {
+	NumberOfCalls            int64
+	NumberOfErrors           int64
+	AverageResponseTime      float64
+	Percentile95ResponseTime float64
+	NumberOfSlowCalls        int64
+	NumberOfVerySlowCalls    int64
+}
+
+// GetBusinessTransactions fetches the business transactions of every given
+// application in parallel, with their statistics for the given time range.
+// Business transactions are sorted by number of calls, busiest first.
+// Applications whose business transactions couldn't be fetched get the
+// failure recorded in Failures.
+func (c *Controller) GetBusinessTransactions(ctx context.Context, appsinfo []AppDetails, startTime int64, endTime int64) ([]AppDetails, error) {
+
+	err := c.forEachApp(ctx, appsinfo, FetchBusinessTransactions, func(ctx context.Context, app *AppDetails) error {
+		return c.getAppBusinessTransactions(ctx, app, startTime, endTime)
+	})
+
+	return appsinfo, err
+
+}
+
+// getAppBusinessTransactions fetches the business transactions of a single
+// application, then their metrics in a single metric-data call.
+func (c *Controller) getAppBusinessTransactions(ctx context.Context, app *AppDetails, startTime int64, endTime int64) error {
+
+	var bts []AppBusinessTransaction
+
+	// Business transactions
+	bturl := "/controller/rest/applications/" + fmt.Sprint(app.Id) + "/business-transactions?output=json"
+
+	err := c.stream(ctx, authToken, "GET", bturl, nil, func(dec *json.Decoder) error {
+
+		var bt businessTransactionResponse
+		if err := dec.Decode(&bt); err != nil {
+			return err
+		}
+
+		bts = append(bts, AppBusinessTransaction{
+			Name:           bt.Name,
+			Id:             bt.Id,
+			TierName:       bt.TierName,
+			EntryPointType: bt.EntryPointType,
+		})
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	// Nothing to get metrics for
+	if len(bts) == 0 {
+		app.BusinessTransactions = bts
+		return nil
+	}
+
+	// Index business transactions by tier|name, as found in metric paths
+	byPath := make(map[string]int, len(bts))
+	for i := range bts {
+		byPath[bts[i].TierName+"|"+bts[i].Name] = i
+	}
+
+	// All the business transaction metrics, rolled up over the time range
+	metrics, err := c.GetMetricData(ctx, app.Id, businessTransactionMetrics, startTime, endTime, true)
+	if err != nil {
+		return err
+	}
+
+	for _, metric := range metrics {
+
+		// Business Transaction Performance|Business Transactions|tier|bt|metric
+		parts := strings.Split(metric.Path, "|")
+		if len(parts) < 5 {
+			continue
+		}
+
+		// Business transaction names may contain |
+		i, ok := byPath[strings.Join(parts[2:len(parts)-1], "|")]
+		if !ok {
+			log.Printf("WARN - Got metric %v for unknown business transaction of application %v.", metric.Path, app.Name)
+			continue
+		}
+
+		sum, value := metric.Sum(), metric.Average()
+		m := &bts[i].Metrics
+
+		switch parts[len(parts)-1] {
+		case "Calls per Minute":
+			m.NumberOfCalls = sum
+		case "Errors per Minute":
+			m.NumberOfErrors = sum
+		case "Average Response Time (ms)":
+			m.AverageResponseTime = value
+		case "95th Percentile Response Time (ms)":
+			m.Percentile95ResponseTime = value
+		case "Number of Slow Calls":
+			m.NumberOfSlowCalls = sum
+		case "Number of Very Slow Calls":
+			m.NumberOfVerySlowCalls = sum
+		}
+
+	}
+
+	// Busiest first
+	sort.SliceStable(bts, func(i, j int) bool {
+		return bts[i].Metrics.NumberOfCalls > bts[j].Metrics.NumberOfCalls
+	})
+
+	app.BusinessTransactions = bts
+
+	return nil
+
+}
@@ -0,0 +1,129 @@
+package appd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// TLSConfig holds the TLS settings used to connect to a Controller.
+type TLSConfig struct {
+
+	// PEM bundle of CAs trusted in addition to the system roots
+	CAFile string
+
+	// PEM client certificate and key for mutual TLS
+	CertFile string
+	KeyFile  string
+
+	// Minimum TLS version: "1.0", "1.1", "1.2" or "1.3" (defaults to "1.2")
+	MinVersion string
+
+	// Skip the Controller certificate verification. Insecure, for testing only
+	InsecureSkipVerify bool
+}
+
+// tlsVersions maps the supported MinVersion values to crypto/tls versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTransport returns the HTTP transport for the given configuration, with
+// the configured proxy (or the one from HTTPS_PROXY/HTTP_PROXY) and TLS
+// settings.
+func newTransport(conf ControllerConfig) (*http.Transport, error) {
+
+	// Start from the default transport for its timeouts and proxy handling
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// Proxy
+	if conf.Proxy != "" {
+
+		proxy, err := url.Parse(conf.Proxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q for %v", conf.Proxy, conf.Name)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+
+		log.Printf("Connecting to %v through proxy %v.", conf.Name, proxy.Redacted())
+
+	}
+
+	tlsConf, err := newTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConf
+
+	return transport, nil
+
+}
+
+// newTLSConfig builds the crypto/tls configuration from conf.TLS.
+func newTLSConfig(conf ControllerConfig) (*tls.Config, error) {
+
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// Minimum version
+	if conf.TLS.MinVersion != "" {
+
+		version, ok := tlsVersions[conf.TLS.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS minimum version %q for %v, use 1.0, 1.1, 1.2 or 1.3", conf.TLS.MinVersion, conf.Name)
+		}
+		tlsConf.MinVersion = version
+
+	}
+
+	// Extra CAs on top of the system roots
+	if conf.TLS.CAFile != "" {
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(conf.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA bundle for %v: %w", conf.Name, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA bundle %v for %v", conf.TLS.CAFile, conf.Name)
+		}
+		tlsConf.RootCAs = pool
+
+	}
+
+	// Client certificate
+	if conf.TLS.CertFile != "" || conf.TLS.KeyFile != "" {
+
+		if conf.TLS.CertFile == "" || conf.TLS.KeyFile == "" {
+			return nil, fmt.Errorf("both a client certificate and key are needed for mutual TLS with %v", conf.Name)
+		}
+
+		cert, err := tls.LoadX509KeyPair(conf.TLS.CertFile, conf.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate for %v: %w", conf.Name, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+
+	}
+
+	// Certificate verification
+	if conf.TLS.InsecureSkipVerify {
+
+		log.Printf("WARN - TLS CERTIFICATE VERIFICATION IS DISABLED for %v (%v). Connections can be intercepted, don't use this in production.", conf.Name, conf.URL)
+		tlsConf.InsecureSkipVerify = true
+
+	}
+
+	return tlsConf, nil
+
+}
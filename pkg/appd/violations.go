@@ -0,0 +1,192 @@
+package appd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Health rule violation severities.
+const (
+	SeverityCritical = "CRITICAL"
+	SeverityWarning  = "WARNING"
+)
+
+type AppHealthRuleViolation struct {
+	Id         int64
+	RuleName   string
+	Severity   string
+	Status     string
+	EntityType string
+	EntityName string
+	Start      time.Time
+
+	// End is zero while the violation is still open
+	End time.Time
+
+	// Duration is the time spent in violation within the report time range
+	Duration time.Duration
+}
+
+// GetHealthRuleViolations fetches the health rule violations of every given
+// application in parallel for the given time range, and counts them by
+// severity along with the total time spent in violation. Applications whose
+// violations couldn't be fetched get the failure recorded in Failures.
+func (c *Controller) GetHealthRuleViolations(ctx context.Context, appsinfo []AppDetails, startTime int64, endTime int64) ([]AppDetails, error) {
+
+	err := c.forEachApp(ctx, appsinfo, FetchViolations, func(ctx context.Context, app *AppDetails) error {
+		return c.getAppHealthRuleViolations(ctx, app, startTime, endTime)
+	})
+
+	return appsinfo, err
+
+}
+
+// getAppHealthRuleViolations fetches the health rule violations of a single
+// application, oldest first.
+func (c *Controller) getAppHealthRuleViolations(ctx context.Context, app *AppDetails, startTime int64, endTime int64) error {
+
+	var violations []AppHealthRuleViolation
+
+	query := url.Values{}
+	query.Set("time-range-type", "BETWEEN_TIMES")
+	query.Set("start-time", fmt.Sprint(startTime))
+	query.Set("end-time", fmt.Sprint(endTime))
+	query.Set("output", "json")
+
+	hrvurl := "/controller/rest/applications/" + fmt.Sprint(app.Id) + "/problems/healthrule-violations?" + query.Encode()
+
+	// Report time range, to clip violations to
+	rangeStart := time.UnixMilli(startTime)
+	rangeEnd := time.UnixMilli(endTime)
+
+	err := c.stream(ctx, authToken, "GET", hrvurl, nil, func(dec *json.Decoder) error {
+
+		var v healthRuleViolationResponse
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+
+		violation := AppHealthRuleViolation{
+			Id:         v.Id,
+			RuleName:   v.Name,
+			Severity:   v.Severity,
+			Status:     v.IncidentStatus,
+			EntityType: v.AffectedEntityDefinition.EntityType,
+			EntityName: v.AffectedEntityDefinition.Name,
+			Start:      time.UnixMilli(v.StartTimeInMillis),
+		}
+		if v.EndTimeInMillis > 0 {
+			violation.End = time.UnixMilli(v.EndTimeInMillis)
+		}
+
+		// Time in violation within the report time range
+		from, until := clipViolation(violation, rangeStart, rangeEnd)
+		if until.After(from) {
+			violation.Duration = until.Sub(from)
+		}
+
+		violations = append(violations, violation)
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	// Oldest first
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Start.Before(violations[j].Start)
+	})
+
+	app.Violations = violations
+
+	// Count them by severity
+	app.Metrics.NumberOfViolations = int64(len(violations))
+	app.Metrics.NumberOfCriticalViolations = 0
+	app.Metrics.NumberOfWarningViolations = 0
+	for _, violation := range violations {
+
+		switch violation.Severity {
+		case SeverityCritical:
+			app.Metrics.NumberOfCriticalViolations++
+		case SeverityWarning:
+			app.Metrics.NumberOfWarningViolations++
+		}
+
+	}
+
+	app.Metrics.TimeInViolation = timeInViolation(violations, rangeStart, rangeEnd)
+
+	return nil
+
+}
+
+// clipViolation returns the part of a violation within the report time
+// range; open violations last until the end of it.
+func clipViolation(violation AppHealthRuleViolation, rangeStart time.Time, rangeEnd time.Time) (time.Time, time.Time) {
+
+	from, until := violation.Start, violation.End
+	if from.Before(rangeStart) {
+		from = rangeStart
+	}
+	if until.IsZero() || until.After(rangeEnd) {
+		until = rangeEnd
+	}
+
+	return from, until
+
+}
+
+// timeInViolation adds up the time spent in violation within the report
+// time range. Overlapping violations of the same rule on the same entity are
+// counted once. violations must be sorted oldest first.
+func timeInViolation(violations []AppHealthRuleViolation, rangeStart time.Time, rangeEnd time.Time) time.Duration {
+
+	type key struct {
+		rule, entityType, entity string
+	}
+
+	var total time.Duration
+
+	// Interval being merged (start, end), per rule and entity
+	open := map[key][2]time.Time{}
+
+	for _, violation := range violations {
+
+		from, until := clipViolation(violation, rangeStart, rangeEnd)
+		if !until.After(from) {
+			continue
+		}
+
+		k := key{violation.RuleName, violation.EntityType, violation.EntityName}
+
+		current, ok := open[k]
+		switch {
+
+		// First interval, or no overlap: close the previous one
+		case !ok || from.After(current[1]):
+			if ok {
+				total += current[1].Sub(current[0])
+			}
+			open[k] = [2]time.Time{from, until}
+
+		// Overlap: extend it
+		case until.After(current[1]):
+			open[k] = [2]time.Time{current[0], until}
+
+		}
+
+	}
+
+	for _, current := range open {
+		total += current[1].Sub(current[0])
+	}
+
+	return total
+
+}
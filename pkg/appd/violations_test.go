@@ -0,0 +1,47 @@
+package appd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeInViolationMergesOverlaps(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * time.Hour)
+	at := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+
+	violations := []AppHealthRuleViolation{
+		// Same rule and entity, overlapping: 1h-5h counted once
+		{RuleName: "CPU", EntityType: "NODE", EntityName: "n1", Start: at(1), End: at(4)},
+		{RuleName: "CPU", EntityType: "NODE", EntityName: "n1", Start: at(2), End: at(3)},
+		{RuleName: "CPU", EntityType: "NODE", EntityName: "n1", Start: at(3), End: at(5)},
+		// Same rule on another entity: counted on its own
+		{RuleName: "CPU", EntityType: "NODE", EntityName: "n2", Start: at(2), End: at(4)},
+		// Same rule and entity, after a gap, still open at the end of the range
+		{RuleName: "CPU", EntityType: "NODE", EntityName: "n1", Start: at(8)},
+	}
+
+	got := timeInViolation(violations, start, end)
+	if want := 8 * time.Hour; got != want {
+		t.Errorf("timeInViolation = %v, want %v", got, want)
+	}
+
+}
+
+func TestTimeInViolationClipsToRange(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(2 * time.Hour)
+
+	violations := []AppHealthRuleViolation{
+		{RuleName: "Errors", Start: start.Add(-5 * time.Hour), End: start.Add(time.Hour)},
+		{RuleName: "Errors", Start: start.Add(-time.Hour)},
+	}
+
+	got := timeInViolation(violations, start, end)
+	if got != 2*time.Hour {
+		t.Errorf("timeInViolation = %v, want the whole range (2h)", got)
+	}
+
+}
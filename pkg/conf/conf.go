@@ -5,32 +5,93 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Define the YAML conf struct
 type Conf struct {
-	Stats StatsConf `yaml:"stats"`
+	Timeout      time.Duration    `yaml:"timeout"`
+	Consolidated ConsolidatedConf `yaml:"consolidated"`
+	Stats        StatsConf        `yaml:"stats"`
 }
-type StatsConf []struct {
-	Name    string     `yaml:"name"`
-	Url     string     `yaml:"url"`
-	Client  string     `yaml:"client"`
-	Secret  string     `yaml:"secret"`
-	Account string     `yaml:"account"`
-	Auth    string     `yaml:"auth"`
-	Report  ReportConf `yaml:"report"`
+type ConsolidatedConf struct {
+	Name  string `yaml:"name"`
+	Title string `yaml:"title"`
 }
-type ReportConf struct {
+type StatsConf []ControllerConf
+type ControllerConf struct {
 	Name        string     `yaml:"name"`
-	Subtitle    string     `yaml:"subtitle"`
-	Timerange   string     `yaml:"timerange"`
-	Scope       string     `yaml:"scope"`
-	Team        string     `yaml:"team"`
-	Description string     `yaml:"description"`
-	Header      HeaderConf `yaml:"header"`
+	Url         string     `yaml:"url"`
+	Client      string     `yaml:"client"`
+	Secret      string     `yaml:"secret"`
+	Account     string     `yaml:"account"`
+	Auth        string     `yaml:"auth"`
+	Proxy       string     `yaml:"proxy"`
+	TLS         TLSConf    `yaml:"tls"`
+	Retry       RetryConf  `yaml:"retry"`
+	RateLimit   float64    `yaml:"ratelimit"`
+	Concurrency int        `yaml:"concurrency"`
+	BatchSize   int        `yaml:"batchsize"`
+	Agents      AgentsConf `yaml:"agents"`
+	Report      ReportConf `yaml:"report"`
+}
+type TLSConf struct {
+	CA                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	MinVersion         string `yaml:"minversion"`
+	InsecureSkipVerify bool   `yaml:"insecureskipverify"`
+}
+type RetryConf struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"maxbackoff"`
+}
+type AgentsConf struct {
+	MinVersion map[string]string `yaml:"minversion"`
+}
+type ReportConf struct {
+	Name              string         `yaml:"name"`
+	Subtitle          string         `yaml:"subtitle"`
+	Timerange         string         `yaml:"timerange"`
+	Scope             string         `yaml:"scope"`
+	Team              string         `yaml:"team"`
+	Description       string         `yaml:"description"`
+	Template          string         `yaml:"template"`
+	Header            HeaderConf     `yaml:"header"`
+	Metrics           []MetricConf   `yaml:"metrics"`
+	Columns           []ColumnConf   `yaml:"columns"`
+	CSV               bool           `yaml:"csv"`
+	HealthRuleDetails *bool          `yaml:"healthruledetails"`
+	Charts            ChartsConf     `yaml:"charts"`
+	Thresholds        ThresholdsConf `yaml:"thresholds"`
 }
+type MetricConf struct {
+	Name   string `yaml:"name"`
+	Path   string `yaml:"path"`
+	Value  string `yaml:"value"`
+	Series bool   `yaml:"series"`
+}
+type ColumnConf struct {
+	Key    string `yaml:"key"`
+	Header string `yaml:"header"`
+	Format string `yaml:"format"`
+}
+type ChartsConf struct {
+	Top int `yaml:"top"`
+}
+type ThresholdsConf struct {
+	ErrorRate     ThresholdConf `yaml:"errorrate"`
+	ResponseTime  ThresholdConf `yaml:"responsetime"`
+	NoHealthRules string        `yaml:"nohealthrules"`
+}
+type ThresholdConf struct {
+	Warning  float64 `yaml:"warning"`
+	Critical float64 `yaml:"critical"`
+}
+
 type HeaderConf struct {
 	B2 string `yaml:"b2"`
 	B3 string `yaml:"b3"`
@@ -0,0 +1,73 @@
+package report
+
+import (
+	"math"
+	"strings"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	BackendsSheetName       = "Backends"
+	SharedBackendsSheetName = "Shared Backends"
+)
+
+// addBackendsSheets lists the backends called by every application, then
+// the backends shared by more than one application on a second sheet.
+func addBackendsSheets(f *excelize.File, appsdetails []appd.AppDetails) error {
+
+	var rows [][]interface{}
+
+	for _, app := range appsdetails {
+
+		for _, backend := range app.Backends {
+			rows = append(rows, []interface{}{
+				app.Name,
+				backend.ExitPointType,
+				backend.Name,
+				backend.TierName,
+				backend.Metrics.NumberOfCalls,
+				backend.Metrics.NumberOfErrors,
+				math.Round(backend.Metrics.AverageResponseTime*10) / 10,
+			})
+		}
+
+	}
+
+	err := newDetailSheet(f, BackendsSheetName, "Backends", []tableColumn{
+		{"Application", 30},
+		{"Type", 15},
+		{"Backend", 45},
+		{"Resolved Tier", 35},
+		{"Number of Calls", 18},
+		{"Number of Errors", 18},
+		{"Avg Response Time (ms)", 18},
+	}, rows)
+	if err != nil {
+		return err
+	}
+
+	// Backends called by more than one app
+	rows = nil
+	for _, backend := range appd.SharedBackends(appsdetails) {
+		rows = append(rows, []interface{}{
+			backend.Name,
+			backend.ExitPointType,
+			len(backend.Applications),
+			strings.Join(backend.Applications, ", "),
+			backend.NumberOfCalls,
+			backend.NumberOfErrors,
+		})
+	}
+
+	return newDetailSheet(f, SharedBackendsSheetName, "Backends Shared by Applications", []tableColumn{
+		{"Backend", 45},
+		{"Type", 15},
+		{"Applications", 15},
+		{"Application Names", 60},
+		{"Number of Calls", 18},
+		{"Number of Errors", 18},
+	}, rows)
+
+}
@@ -0,0 +1,502 @@
+package report
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	ChartsSheetName = "Charts"
+
+	// defaultChartTop is the number of applications on the top charts when
+	// ReportInfo.ChartTop isn't set
+	defaultChartTop = 10
+
+	// Size of every chart in pixels, two charts side by side
+	chartWidth  = 600
+	chartHeight = 300
+
+	// Rows taken by one line of charts, including a gap
+	chartRows = 17
+
+	// First row of charts, under the branding header and the sheet title
+	chartsRow = 9
+
+	// chartsPlaceholder marks the first row of charts on a Charts sheet of
+	// the template, row 9 when there is none
+	chartsPlaceholder = "charts"
+)
+
+// errorRateBuckets are the error rate ranges (in %) of the error rate
+// distribution chart: upper bound excluded, except for the first one.
+var errorRateBuckets = []struct {
+	Name string
+	Max  float64
+}{
+	{"0%", 0},
+	{"< 1%", 1},
+	{"1-5%", 5},
+	{"5-10%", 10},
+	{">= 10%", math.Inf(1)},
+}
+
+// chartData is a table written under the charts and the chart drawn from it:
+// categories in the first column, one series per other column.
+type chartData struct {
+	Title   string
+	Type    excelize.ChartType
+	Columns []tableColumn
+	Rows    [][]interface{}
+}
+
+// addChartsSheet adds a sheet with native Excel charts: top applications by
+// calls and by errors, error rate distribution and line charts of the
+// busiest applications over the report time range: calls per minute and
+// response time when their series were fetched, and every custom metric
+// kept as series. The data of the charts is written under them. A Charts sheet
+// of the template is used as it is, else the sheet gets the branding header
+// of the built-in layout, filled like the template placeholders.
+func addChartsSheet(f *excelize.File, appsdetails []appd.AppDetails, info ReportInfo) error {
+
+	if len(appsdetails) == 0 {
+		return nil
+	}
+
+	top := info.ChartTop
+	if top <= 0 {
+		top = defaultChartTop
+	}
+
+	// Busiest apps first
+	apps := make([]appd.AppDetails, len(appsdetails))
+	copy(apps, appsdetails)
+	sort.SliceStable(apps, func(i, j int) bool {
+		return apps[i].Metrics.NumberOfCalls > apps[j].Metrics.NumberOfCalls
+	})
+
+	// Calls and errors of the apps with statistics only
+	var withStats []appd.AppDetails
+	for _, app := range apps {
+		if app.HasStats() {
+			withStats = append(withStats, app)
+		}
+	}
+
+	charts := []chartData{
+		topAppsChart(withStats, top, "Number of Calls", func(app appd.AppDetails) int64 { return app.Metrics.NumberOfCalls }),
+		topAppsChart(withStats, top, "Number of Errors", func(app appd.AppDetails) int64 { return app.Metrics.NumberOfErrors }),
+		errorRateChart(withStats),
+	}
+	for _, metric := range appd.PerformanceSeries {
+		charts = append(charts, metricSeriesChart(apps, top, metric.Name, performanceSeries))
+	}
+	for _, name := range info.CustomMetrics {
+		charts = append(charts, metricSeriesChart(apps, top, name, customMetrics))
+	}
+
+	// Charts without data are left out
+	var drawn []chartData
+	for _, chart := range charts {
+		if len(chart.Rows) > 0 && len(chart.Columns) > 1 {
+			drawn = append(drawn, chart)
+		}
+	}
+
+	// Styling and font of sheet titles
+	style, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Size: 20, Color: "2B4492", Bold: true}})
+	if err != nil {
+		return err
+	}
+
+	// Laid out by the template, else as the built-in one
+	firstRow := chartsRow
+
+	index, err := f.GetSheetIndex(ChartsSheetName)
+	if err != nil {
+		return err
+	}
+
+	if index >= 0 {
+
+		// Charts from the {{charts}} placeholder on
+		sheet, cell, err := findPlaceholder(f, chartsPlaceholder)
+		if err != nil {
+			return err
+		}
+		if sheet == ChartsSheetName {
+			if _, firstRow, err = excelize.CellNameToCoordinates(cell); err != nil {
+				return err
+			}
+			if err := f.SetCellValue(sheet, cell, nil); err != nil {
+				return err
+			}
+		}
+
+	} else if err := addChartsLayout(f, style, templateValues(appsdetails, info)); err != nil {
+		return err
+	}
+
+	// Chart data under the charts, one table after the other
+	dataRow := firstRow + chartRows*((len(drawn)+1)/2) + 1
+
+	if err := f.SetCellStyle(ChartsSheetName, fmt.Sprintf("B%d", dataRow), fmt.Sprintf("B%d", dataRow), style); err != nil {
+		return err
+	}
+	if err := f.SetCellValue(ChartsSheetName, fmt.Sprintf("B%d", dataRow), "Chart Data"); err != nil {
+		return err
+	}
+	if err := f.SetRowHeight(ChartsSheetName, dataRow, 30); err != nil {
+		return err
+	}
+
+	headerRows := make([]int, len(drawn))
+	row := dataRow + 2
+
+	for i, chart := range drawn {
+
+		// Table title
+		if err := f.SetCellValue(ChartsSheetName, fmt.Sprintf("B%d", row), chart.Title); err != nil {
+			return err
+		}
+
+		headerRows[i] = row + 1
+		if err := writeTable(f, ChartsSheetName, headerRows[i], chart.Columns, chart.Rows); err != nil {
+			return err
+		}
+
+		row = headerRows[i] + len(chart.Rows) + 3
+
+	}
+
+	// Charts, two per line. Placed once all column widths are set, as their
+	// position and size are worked out from them.
+	secondColumn, err := columnAfter(f, ChartsSheetName, chartWidth+20)
+	if err != nil {
+		return err
+	}
+
+	for i, chart := range drawn {
+
+		column := "B"
+		if i%2 == 1 {
+			column = secondColumn
+		}
+
+		cell := fmt.Sprintf("%v%d", column, firstRow+chartRows*(i/2))
+
+		if err := f.AddChart(ChartsSheetName, cell, newChart(chart, headerRows[i])); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// addChartsLayout adds the Charts sheet of the built-in layout: the branding
+// header, as on the main sheet, and the sheet title.
+func addChartsLayout(f *excelize.File, titleStyle int, values map[string]interface{}) error {
+
+	if _, err := f.NewSheet(ChartsSheetName); err != nil {
+		return err
+	}
+
+	// Left margin
+	if err := f.SetColWidth(ChartsSheetName, "A", "A", 6); err != nil {
+		return err
+	}
+
+	// Branding header, as on the main sheet
+	if err := addBrandingHeader(f, ChartsSheetName, brandingPlaceholders); err != nil {
+		return err
+	}
+	if err := fillSheetPlaceholders(f, ChartsSheetName, values); err != nil {
+		return err
+	}
+
+	// Sheet title
+	if err := f.SetCellStyle(ChartsSheetName, "B7", "B7", titleStyle); err != nil {
+		return err
+	}
+	if err := f.SetCellValue(ChartsSheetName, "B7", "Charts"); err != nil {
+		return err
+	}
+
+	return f.SetRowHeight(ChartsSheetName, 7, 30)
+
+}
+
+// columnAfter returns the first column starting at least width pixels to
+// the right of column B.
+func columnAfter(f *excelize.File, sheet string, width int) (string, error) {
+
+	var pixels float64
+
+	for i := 2; ; i++ {
+
+		column, err := excelize.ColumnNumberToName(i)
+		if err != nil {
+			return "", err
+		}
+
+		if pixels >= float64(width) {
+			return column, nil
+		}
+
+		// Same conversion as Excel for the default font
+		chars, err := f.GetColWidth(sheet, column)
+		if err != nil {
+			return "", err
+		}
+		pixels += math.Ceil(chars*7 + 0.5 + 5)
+
+	}
+
+}
+
+// newChart returns the chart of data, whose table has its column names on
+// headerRow.
+func newChart(data chartData, headerRow int) *excelize.Chart {
+
+	first, last := headerRow+1, headerRow+len(data.Rows)
+
+	chart := &excelize.Chart{
+		Type:      data.Type,
+		Title:     []excelize.RichTextRun{{Text: data.Title}},
+		Dimension: excelize.ChartDimension{Width: chartWidth, Height: chartHeight},
+		Legend:    excelize.ChartLegend{Position: "none"},
+	}
+
+	for i := 1; i < len(data.Columns); i++ {
+
+		column, _ := excelize.ColumnNumberToName(i + 2)
+
+		chart.Series = append(chart.Series, excelize.ChartSeries{
+			Name:       fmt.Sprintf("%v!$%v$%d", ChartsSheetName, column, headerRow),
+			Categories: fmt.Sprintf("%v!$B$%d:$B$%d", ChartsSheetName, first, last),
+			Values:     fmt.Sprintf("%v!$%v$%d:$%v$%d", ChartsSheetName, column, first, column, last),
+		})
+
+	}
+
+	switch data.Type {
+
+	case excelize.Bar:
+		// Top application at the top
+		chart.XAxis.ReverseOrder = true
+		chart.PlotArea.ShowVal = true
+
+	case excelize.Col:
+		chart.PlotArea.ShowVal = true
+
+	case excelize.Line:
+		chart.Legend.Position = "bottom"
+		chart.ShowBlanksAs = "gap"
+
+	}
+
+	return chart
+
+}
+
+// topAppsChart is a bar chart of the top applications by value, ties
+// keeping the order of apps. Apps with a zero value are left out.
+func topAppsChart(apps []appd.AppDetails, top int, name string, value func(appd.AppDetails) int64) chartData {
+
+	ranked := make([]appd.AppDetails, len(apps))
+	copy(ranked, apps)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return value(ranked[i]) > value(ranked[j])
+	})
+
+	var rows [][]interface{}
+	for _, app := range ranked {
+		if len(rows) == top || value(app) <= 0 {
+			break
+		}
+		rows = append(rows, []interface{}{app.Name, value(app)})
+	}
+
+	return chartData{
+		Title:   fmt.Sprintf("Top %d Applications by %v", top, name),
+		Type:    excelize.Bar,
+		Columns: []tableColumn{{"Application", 30}, {name, 20}},
+		Rows:    rows,
+	}
+
+}
+
+// errorRateChart is a column chart of the number of applications per error
+// rate range. Apps without calls are left out.
+func errorRateChart(apps []appd.AppDetails) chartData {
+
+	counts := make([]int, len(errorRateBuckets))
+
+	var withCalls int
+	for _, app := range apps {
+
+		if app.Metrics.NumberOfCalls <= 0 {
+			continue
+		}
+		withCalls++
+
+		rate := float64(app.Metrics.NumberOfErrors) * 100 / float64(app.Metrics.NumberOfCalls)
+		for i, bucket := range errorRateBuckets {
+			if rate < bucket.Max || (i == 0 && rate == 0) {
+				counts[i]++
+				break
+			}
+		}
+
+	}
+
+	var rows [][]interface{}
+	if withCalls > 0 {
+		for i, bucket := range errorRateBuckets {
+			rows = append(rows, []interface{}{bucket.Name, counts[i]})
+		}
+	}
+
+	return chartData{
+		Title:   "Error Rate Distribution",
+		Type:    excelize.Col,
+		Columns: []tableColumn{{"Error Rate", 30}, {"Applications", 20}},
+		Rows:    rows,
+	}
+
+}
+
+// performanceSeries returns the calls and response time series of an app.
+func performanceSeries(app appd.AppDetails) []appd.CustomMetricValue {
+	return app.PerformanceSeries
+}
+
+// customMetrics returns the custom metrics of an app.
+func customMetrics(app appd.AppDetails) []appd.CustomMetricValue {
+	return app.CustomMetrics
+}
+
+// metricSeriesChart is a line chart of the named metric of metrics (the
+// custom metrics or the performance series) over time, one line for each of
+// the top (busiest) applications with a series for it. Several series
+// matched by a wildcard path are combined as their values.
+func metricSeriesChart(apps []appd.AppDetails, top int, name string, metrics func(app appd.AppDetails) []appd.CustomMetricValue) chartData {
+
+	chart := chartData{
+		Title:   name,
+		Type:    excelize.Line,
+		Columns: []tableColumn{{"Time", 30}},
+	}
+
+	// Value of every app at every time
+	var lines []map[time.Time]float64
+	times := map[time.Time]bool{}
+
+	for _, app := range apps {
+
+		if len(lines) == top {
+			break
+		}
+
+		for _, metric := range metrics(app) {
+
+			if metric.Name != name || len(metric.Series) == 0 {
+				continue
+			}
+
+			line := combineSeries(metric.Series, metric.Aggregation)
+			if len(line) == 0 {
+				continue
+			}
+
+			for t := range line {
+				times[t] = true
+			}
+
+			lines = append(lines, line)
+			chart.Columns = append(chart.Columns, tableColumn{app.Name, 20})
+
+		}
+
+	}
+
+	// One row per time, oldest first
+	var sorted []time.Time
+	for t := range times {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+
+	for _, t := range sorted {
+
+		row := []interface{}{t.Format("2006-01-02 15:04")}
+		for _, line := range lines {
+			// No value is left blank (nil) so the line has a gap: an empty
+			// string would be drawn as 0
+			if value, ok := line[t]; ok {
+				row = append(row, math.Round(value*100)/100)
+			} else {
+				row = append(row, nil)
+			}
+		}
+
+		chart.Rows = append(chart.Rows, row)
+
+	}
+
+	return chart
+
+}
+
+// combineSeries returns the value of the series at every point in time,
+// reading each point as the aggregation of the metric: sums are added up,
+// minimums and maximums kept, averages averaged.
+func combineSeries(series []appd.MetricSeries, aggregation string) map[time.Time]float64 {
+
+	values := map[time.Time]float64{}
+	counts := map[time.Time]int{}
+
+	for _, s := range series {
+
+		for _, point := range s.Points {
+
+			var value float64
+			switch aggregation {
+			case appd.AggregateSum:
+				value = float64(point.Sum)
+			case appd.AggregateMin:
+				value = float64(point.Min)
+			case appd.AggregateMax:
+				value = float64(point.Max)
+			default:
+				value = float64(point.Value)
+			}
+
+			n := counts[point.Time]
+			switch {
+			case n == 0:
+				values[point.Time] = value
+			case aggregation == appd.AggregateSum:
+				values[point.Time] += value
+			case aggregation == appd.AggregateMin:
+				values[point.Time] = math.Min(values[point.Time], value)
+			case aggregation == appd.AggregateMax:
+				values[point.Time] = math.Max(values[point.Time], value)
+			default:
+				values[point.Time] += (value - values[point.Time]) / float64(n+1)
+			}
+			counts[point.Time] = n + 1
+
+		}
+
+	}
+
+	return values
+
+}
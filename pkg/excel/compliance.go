@@ -0,0 +1,58 @@
+package report
+
+import (
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	ComplianceSheetName = "Agent Compliance"
+)
+
+// agentsAudited tells if the agent version audit ran on any app.
+func agentsAudited(appsdetails []appd.AppDetails) bool {
+
+	for i := range appsdetails {
+		if appsdetails[i].AgentCompliance.Audited > 0 {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// addComplianceSheet lists the agents out of the minimum-version policy.
+func addComplianceSheet(f *excelize.File, appsdetails []appd.AppDetails) error {
+
+	var rows [][]interface{}
+
+	for _, app := range appsdetails {
+
+		for _, violation := range app.AgentCompliance.Violations {
+			rows = append(rows, []interface{}{
+				app.Name,
+				violation.Tier,
+				violation.Node,
+				violation.Machine,
+				violation.AgentType,
+				violation.Version,
+				violation.MinVersion,
+				violation.Reason,
+			})
+		}
+
+	}
+
+	return newDetailSheet(f, ComplianceSheetName, "Agents Out of Policy", []tableColumn{
+		{"Application", 30},
+		{"Tier", 25},
+		{"Node", 25},
+		{"Machine", 22},
+		{"Agent Type", 22},
+		{"Agent Version", 60},
+		{"Minimum Version", 18},
+		{"Reason", 28},
+	}, rows)
+
+}
@@ -0,0 +1,410 @@
+package report
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	OverviewSheetName = "Overview"
+	AllAppsSheetName  = "All Applications"
+
+	// maxSheetName is the longest sheet name Excel accepts
+	maxSheetName = 31
+)
+
+// ControllerReport is the data of one controller, see BuildConsolidatedReport.
+type ControllerReport struct {
+	Info ReportInfo
+	Apps []appd.AppDetails
+}
+
+// BuildConsolidatedReport writes the reports of several controllers to a
+// single <name>.xlsx: an overview sheet with totals per controller, a
+// combined application table with a Controller column, and one sheet per
+// controller with its main table.
+func BuildConsolidatedReport(name string, title string, reports []ControllerReport) error {
+
+	f := excelize.NewFile()
+	defer f.Close()
+
+	// Overview first
+	if err := f.SetSheetName("Sheet1", OverviewSheetName); err != nil {
+		return err
+	}
+
+	if title == "" {
+		title = "Controllers Overview"
+	}
+
+	if err := addOverviewSheet(f, title, reports); err != nil {
+		return err
+	}
+
+	// All apps of all controllers
+	if err := addAllAppsSheet(f, reports); err != nil {
+		return err
+	}
+
+	// Main table of every controller
+	used := map[string]bool{strings.ToLower(OverviewSheetName): true, strings.ToLower(AllAppsSheetName): true}
+
+	for _, report := range reports {
+
+		sheet := uniqueSheetName(report.Info.Profile, used)
+
+		if err := addControllerSheet(f, sheet, report); err != nil {
+			return err
+		}
+
+	}
+
+	return f.SaveAs(name + ".xlsx")
+
+}
+
+// addOverviewSheet lists the totals of every controller, and of all of them.
+func addOverviewSheet(f *excelize.File, title string, reports []ControllerReport) error {
+
+	var (
+		rows  [][]interface{}
+		total controllerTotals
+	)
+
+	for _, report := range reports {
+
+		totals := newControllerTotals(report.Apps)
+		total.add(totals)
+
+		status := "Complete"
+		if report.Info.Incomplete != "" {
+			status = "Incomplete - " + report.Info.Incomplete
+		}
+
+		rows = append(rows, append([]interface{}{
+			report.Info.Profile,
+			report.Info.ControllerURL,
+			report.Info.TimeRangeStart,
+			report.Info.TimeRangeEnd,
+		}, append(totals.values(), status)...))
+
+	}
+
+	// All controllers
+	if len(reports) > 1 {
+		rows = append(rows, append([]interface{}{"All Controllers", "", "", ""}, append(total.values(), "")...))
+	}
+
+	return newDetailSheet(f, OverviewSheetName, title, []tableColumn{
+		{"Controller", 25},
+		{"URL", 40},
+		{"From", 22},
+		{"Until", 22},
+		{"Applications", 14},
+		{"Number of Calls", 18},
+		{"Number of Errors", 18},
+		{"Error Rate %", 14},
+		{"Enabled Alerts", 14},
+		{"Disabled Alerts", 14},
+		{"Nodes", 12},
+		{"Violations", 12},
+		{"Critical Violations", 14},
+		{"Stats Missing", 14},
+		{"Status", 40},
+	}, rows)
+
+}
+
+// controllerTotals adds up the main figures of the apps of a controller.
+type controllerTotals struct {
+	Applications       int
+	Calls              int64
+	Errors             int64
+	EnabledAlerts      float64
+	DisabledAlerts     float64
+	Nodes              int64
+	Violations         int64
+	CriticalViolations int64
+	StatsMissing       int
+}
+
+// newControllerTotals returns the totals of the given apps.
+func newControllerTotals(appsdetails []appd.AppDetails) controllerTotals {
+
+	var t controllerTotals
+
+	for _, app := range appsdetails {
+
+		t.Applications++
+
+		// Calls and errors of the apps with statistics only
+		if app.HasStats() {
+			t.Calls += app.Metrics.NumberOfCalls
+			t.Errors += app.Metrics.NumberOfErrors
+		}
+
+		t.EnabledAlerts += app.Metrics.NumberOfActiveHealthRules
+		t.DisabledAlerts += app.Metrics.NumberOfInactiveHealthRules
+		t.Nodes += app.Metrics.NumberOfNodes
+		t.Violations += app.Metrics.NumberOfViolations
+		t.CriticalViolations += app.Metrics.NumberOfCriticalViolations
+
+		if app.StatsMissing {
+			t.StatsMissing++
+		}
+
+	}
+
+	return t
+
+}
+
+// add adds other to the totals.
+func (t *controllerTotals) add(other controllerTotals) {
+	t.Applications += other.Applications
+	t.Calls += other.Calls
+	t.Errors += other.Errors
+	t.EnabledAlerts += other.EnabledAlerts
+	t.DisabledAlerts += other.DisabledAlerts
+	t.Nodes += other.Nodes
+	t.Violations += other.Violations
+	t.CriticalViolations += other.CriticalViolations
+	t.StatsMissing += other.StatsMissing
+}
+
+// values returns the totals as overview columns.
+func (t controllerTotals) values() []interface{} {
+
+	var rate interface{} = ""
+	if t.Calls > 0 {
+		rate = math.Round(float64(t.Errors)*100/float64(t.Calls)*100) / 100
+	}
+
+	return []interface{}{
+		t.Applications,
+		t.Calls,
+		t.Errors,
+		rate,
+		t.EnabledAlerts,
+		t.DisabledAlerts,
+		t.Nodes,
+		t.Violations,
+		t.CriticalViolations,
+		t.StatsMissing,
+	}
+
+}
+
+// addAllAppsSheet lists the apps of all controllers, after the name of their
+// controller, with the main table columns of every controller: when they
+// differ, every column found on any of them, left empty for the apps of the
+// controllers without it.
+func addAllAppsSheet(f *excelize.File, reports []ControllerReport) error {
+
+	controller, _ := appd.LookupColumn("controller")
+	columns := []appd.Column{controller}
+
+	// Columns of every controller, by key
+	byKey := make([]map[string]appd.Column, len(reports))
+
+	for i, report := range reports {
+
+		byKey[i] = map[string]appd.Column{}
+
+		for _, column := range mainTableColumns(report.Info) {
+
+			if column.Key == controller.Key {
+				continue
+			}
+
+			// First seen columns give the header and format
+			if !hasColumn(columns, column.Key) {
+				columns = append(columns, column)
+			}
+			byKey[i][column.Key] = column
+
+		}
+
+	}
+
+	var rows [][]interface{}
+	for i, report := range reports {
+
+		// Columns of this controller, in the order of the sheet
+		own := []appd.Column{controller}
+		for _, column := range columns[1:] {
+			if c, ok := byKey[i][column.Key]; ok {
+				own = append(own, c)
+			} else {
+				own = append(own, appd.Column{Key: column.Key, Value: blankValue})
+			}
+		}
+
+		rows = append(rows, mainTableRows(report.Apps, own)...)
+
+	}
+
+	if err := newDetailSheet(f, AllAppsSheetName, "All Applications", detailColumns(columns), rows); err != nil {
+		return err
+	}
+
+	if err := setNumberFormats(f, AllAppsSheetName, columns, len(rows)); err != nil {
+		return err
+	}
+
+	// Health fills and data bars; thresholds differ between
+	// controllers, so the values checked against them aren't filled here
+	return addThresholdFormats(f, AllAppsSheetName, columns, 2, 5, 4+len(rows), Thresholds{})
+
+}
+
+// addControllerSheet adds the main table of a controller, with its time
+// range and conditional formats.
+func addControllerSheet(f *excelize.File, sheet string, report ControllerReport) error {
+
+	columns := mainTableColumns(report.Info)
+	rows := mainTableRows(report.Apps, columns)
+
+	title := report.Info.Profile
+	if report.Info.Name != "" {
+		title += " - " + report.Info.Name
+	}
+
+	if err := newDetailSheet(f, sheet, title, detailColumns(columns), rows); err != nil {
+		return err
+	}
+
+	// Time range and controller under the title
+	context := fmt.Sprintf("%v - %v   %v", report.Info.TimeRangeStart, report.Info.TimeRangeEnd, report.Info.ControllerURL)
+	if report.Info.Incomplete != "" {
+		context += "   INCOMPLETE REPORT - " + report.Info.Incomplete
+	}
+	if err := f.SetCellValue(sheet, "B3", context); err != nil {
+		return err
+	}
+
+	if err := setNumberFormats(f, sheet, columns, len(rows)); err != nil {
+		return err
+	}
+
+	// Table starts in column B, data from row 5
+	return addThresholdFormats(f, sheet, columns, 2, 5, 4+len(rows), report.Info.Thresholds)
+
+}
+
+// blankValue is the value of a column a controller doesn't have.
+func blankValue(appd.AppDetails) interface{} {
+	return ""
+}
+
+// hasColumn tells if columns has one with the given key.
+func hasColumn(columns []appd.Column, key string) bool {
+
+	for _, column := range columns {
+		if column.Key == key {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// setNumberFormats applies the number formats of the columns to the lines
+// of a detail sheet table (column B on, data from row 5), over their fills.
+func setNumberFormats(f *excelize.File, sheet string, columns []appd.Column, rows int) error {
+
+	// Styles with number format, by fill style and column
+	formatted := map[[2]int]int{}
+
+	for i, column := range columns {
+
+		if column.Format == "" {
+			continue
+		}
+
+		for row := 5; row < 5+rows; row++ {
+
+			cell, err := excelize.CoordinatesToCellName(2+i, row)
+			if err != nil {
+				return err
+			}
+
+			fill, err := f.GetCellStyle(sheet, cell)
+			if err != nil {
+				return err
+			}
+
+			style, ok := formatted[[2]int{fill, i}]
+			if !ok {
+				if style, err = withNumberFormat(f, fill, column.Format); err != nil {
+					return err
+				}
+				formatted[[2]int{fill, i}] = style
+			}
+
+			if err := f.SetCellStyle(sheet, cell, cell, style); err != nil {
+				return err
+			}
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// detailColumns returns the detail sheet columns of main table columns.
+func detailColumns(columns []appd.Column) []tableColumn {
+
+	names := make([]tableColumn, len(columns))
+	for i, column := range columns {
+		names[i] = tableColumn{column.Header, 18}
+		if i == 0 {
+			names[i].Width = 30
+		}
+	}
+
+	return names
+
+}
+
+// uniqueSheetName returns a valid sheet name for name, not in used
+// (lowercase names, as Excel ignores case), and marks it as used.
+func uniqueSheetName(name string, used map[string]bool) string {
+
+	// Characters Excel doesn't accept in sheet names
+	name = strings.NewReplacer(":", "_", "\\", "_", "/", "_", "?", "_", "*", "_", "[", "(", "]", ")").Replace(name)
+	name = strings.Trim(name, "'")
+	if name == "" {
+		name = "Controller"
+	}
+
+	unique := truncate(name, maxSheetName)
+	for n := 2; used[strings.ToLower(unique)]; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		unique = truncate(name, maxSheetName-len(suffix)) + suffix
+	}
+
+	used[strings.ToLower(unique)] = true
+
+	return unique
+
+}
+
+// truncate cuts s to at most n characters.
+func truncate(s string, n int) string {
+
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	return string([]rune(s)[:n])
+
+}
@@ -0,0 +1,92 @@
+package report
+
+import (
+	"strings"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	CoverageSheetName = "Alerting Coverage"
+)
+
+// addCoverageSheet shows, for every application, whether its health rules
+// are routed to a notification, along with its orphaned health rules. Values
+// depending on health rules or policies that couldn't be fetched are left
+// empty, the notification path being "Unknown".
+func addCoverageSheet(f *excelize.File, appsdetails []appd.AppDetails) error {
+
+	var rows [][]interface{}
+
+	for _, app := range appsdetails {
+
+		// Enabled rules and policies, and notification actions in use
+		enabledRules, enabledPolicies := 0, 0
+		var notifications, orphaned []string
+		for _, rule := range app.Alerting {
+			if rule.Active {
+				enabledRules++
+			}
+			if rule.Orphaned {
+				orphaned = append(orphaned, rule.Name)
+			}
+		}
+		for _, policy := range app.Policies {
+			if !policy.Enabled {
+				continue
+			}
+			enabledPolicies++
+			for _, action := range policy.Actions {
+				if action.Notifies() {
+					notifications = append(notifications, action.Name+" ("+action.Type+")")
+				}
+			}
+		}
+
+		notificationPath := "No"
+		if app.NotificationPath {
+			notificationPath = "Yes"
+		}
+
+		row := []interface{}{
+			app.Name,
+			enabledRules,
+			app.Metrics.NumberOfOrphanedHealthRules,
+			enabledPolicies,
+			len(app.Actions),
+			strings.Join(notifications, ", "),
+			notificationPath,
+			strings.Join(orphaned, ", "),
+		}
+
+		// What couldn't be fetched is unknown, not missing: the rules and
+		// policies are both needed to tell orphaned rules and notification path
+		rulesFailed := app.Failed(appd.FetchHealthRules)
+		policiesFailed := app.Failed(appd.FetchPolicies)
+		if rulesFailed {
+			row[1] = ""
+		}
+		if policiesFailed {
+			row[3], row[4], row[5] = "", "", ""
+		}
+		if rulesFailed || policiesFailed {
+			row[2], row[6], row[7] = "", "Unknown", ""
+		}
+
+		rows = append(rows, row)
+
+	}
+
+	return newDetailSheet(f, CoverageSheetName, "Alerting Coverage", []tableColumn{
+		{"Application", 30},
+		{"Enabled Health Rules", 20},
+		{"Orphaned Health Rules", 20},
+		{"Enabled Policies", 20},
+		{"Actions", 12},
+		{"Notification Actions in Use", 45},
+		{"Notification Path", 20},
+		{"Orphaned Health Rule Names", 60},
+	}, rows)
+
+}
@@ -0,0 +1,55 @@
+package report
+
+import (
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	HealthRulesSheetName = "Health Rules"
+)
+
+// addHealthRulesSheet lists the health rules of every application with what
+// they affect, their schedule and their critical and warning conditions.
+func addHealthRulesSheet(f *excelize.File, appsdetails []appd.AppDetails) error {
+
+	var rows [][]interface{}
+
+	for _, app := range appsdetails {
+
+		for _, rule := range app.Alerting {
+
+			enabled := "No"
+			if rule.Active {
+				enabled = "Yes"
+			}
+
+			rows = append(rows, []interface{}{
+				app.Name,
+				rule.Name,
+				enabled,
+				rule.AffectedEntityType,
+				rule.AffectsScope,
+				rule.Schedule,
+				rule.EvaluationMinutes,
+				rule.Critical.String(),
+				rule.Warning.String(),
+			})
+
+		}
+
+	}
+
+	return newDetailSheet(f, HealthRulesSheetName, "Health Rules", []tableColumn{
+		{"Application", 30},
+		{"Health Rule", 50},
+		{"Enabled", 10},
+		{"Affects", 35},
+		{"Scope", 40},
+		{"Schedule", 18},
+		{"Evaluation (min)", 16},
+		{"Critical Condition", 80},
+		{"Warning Condition", 80},
+	}, rows)
+
+}
@@ -0,0 +1,76 @@
+package report
+
+import (
+	"time"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	MetricSeriesSheetName = "Metric Series"
+)
+
+// hasMetricSeries tells if any app has a custom metric kept as series.
+func hasMetricSeries(appsdetails []appd.AppDetails) bool {
+
+	for _, app := range appsdetails {
+		for _, metric := range app.CustomMetrics {
+			if len(metric.Series) > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+
+}
+
+// addMetricSeriesSheet lists the data points of the custom metrics kept as
+// series, one line per application, metric and point. The sheet is only
+// added when there are series.
+func addMetricSeriesSheet(f *excelize.File, appsdetails []appd.AppDetails) error {
+
+	if !hasMetricSeries(appsdetails) {
+		return nil
+	}
+
+	var rows [][]interface{}
+
+	for _, app := range appsdetails {
+
+		for _, metric := range app.CustomMetrics {
+
+			for _, series := range metric.Series {
+
+				for _, point := range series.Points {
+					rows = append(rows, []interface{}{
+						app.Name,
+						metric.Name,
+						series.Path,
+						point.Time.Format(time.RFC3339),
+						point.Value,
+						point.Min,
+						point.Max,
+						point.Sum,
+					})
+				}
+
+			}
+
+		}
+
+	}
+
+	return newDetailSheet(f, MetricSeriesSheetName, "Metric Series", []tableColumn{
+		{"Application", 30},
+		{"Metric", 30},
+		{"Metric Path", 60},
+		{"Time", 24},
+		{"Value", 14},
+		{"Min", 14},
+		{"Max", 14},
+		{"Sum", 16},
+	}, rows)
+
+}
@@ -11,154 +11,226 @@ const (
 	SheetName = "Controller Applications Report"
 )
 
-func BuildExcelReport(
-	appsdetails []appd.AppDetails,
-	profile string,
-	timeRangeStart string,
-	timeRangeEnd string,
-	reportName string,
-	scope string,
-	team string,
-	description string,
-	controllerURL string,
-	b2 string,
-	b3 string,
-	b4 string,
-	b5 string,
-	reportSubtitle string) error {
-
-	var (
-		err        error
-		reportData = [][]interface{}{}
-	)
-
-	// Convert unix ts to human date
-
-	// Create file
-	f := excelize.NewFile()
-
-	// Select default spreadsheet and rename
-	index, err := f.NewSheet("Sheet1")
-	if err != nil {
-		return err
-	}
+// ReportInfo describes the report header and the context of the data.
+type ReportInfo struct {
+	Profile        string
+	TimeRangeStart string
+	TimeRangeEnd   string
+	Name           string
+	Subtitle       string
+	Scope          string
+	Team           string
+	Description    string
+	ControllerURL  string
+	B2             string
+	B3             string
+	B4             string
+	B5             string
+
+	// Template is an .xlsx file laid out with placeholders (see
+	// fillPlaceholders) the report is built from, the built-in layout when
+	// not set
+	Template string
+
+	// Columns of the main table, appd.DefaultColumns when not set
+	Columns []appd.Column
+
+	// CustomMetrics names the custom metrics (see appd.GetCustomMetrics),
+	// charted when kept as series and added as columns to the default main
+	// table
+	CustomMetrics []string
+
+	// ChartTop is the number of applications on the top calls and errors
+	// charts, 10 when not set
+	ChartTop int
+
+	// Thresholds drive the conditional formatting of the main table, and
+	// add a Health column when set
+	Thresholds Thresholds
+
+	// HealthRuleDetails is set when the health rule details were fetched
+	// (see appd.GetHealthRuleDetails), adding the Health Rules sheet
+	HealthRuleDetails bool
+
+	// Incomplete is set when data collection was interrupted (cancelled,
+	// timed out or failed) and explains why. The report is marked accordingly.
+	Incomplete string
+}
 
-	// Select active sheet
-	f.SetActiveSheet(index)
+func BuildExcelReport(appsdetails []appd.AppDetails, info ReportInfo) error {
 
-	// Rename active sheet
-	f.SetSheetName("Sheet1", SheetName)
+	var err error
 
-	// Set column width
-	err = f.SetColWidth(SheetName, "A", "A", 6)
-	err = f.SetColWidth(SheetName, "H", "H", 6)
-	err = f.SetColWidth(SheetName, "B", "B", 30)
-	err = f.SetColWidth(SheetName, "C", "C", 20)
-	err = f.SetColWidth(SheetName, "D", "D", 20)
-	err = f.SetColWidth(SheetName, "E", "E", 20)
-	err = f.SetColWidth(SheetName, "F", "F", 20)
-	err = f.SetColWidth(SheetName, "G", "G", 6)
+	// Main table columns and one line per app
+	columns := mainTableColumns(info)
+	reportData := mainTableRows(appsdetails, columns)
 
-	// Height of 1st row
-	err = f.SetRowHeight(SheetName, 1, 12)
+	// Layout of the report: the given template or the built-in one
+	var f *excelize.File
+	if info.Template != "" {
+		f, err = excelize.OpenFile(info.Template)
+		if err != nil {
+			return fmt.Errorf("couldn't open template %v: %w", info.Template, err)
+		}
+	} else {
+		f, err = defaultTemplate(len(columns))
+		if err != nil {
+			return err
+		}
+	}
+	defer f.Close()
 
-	// Merge 1st row cells
-	err = f.MergeCell(SheetName, "A1", "H1")
+	// Where the main table goes
+	sheet, cell, err := findPlaceholder(f, appsTablePlaceholder)
+	if err != nil {
+		return err
+	}
+	if sheet == "" {
+		return fmt.Errorf("template %v has no {{%v}} placeholder or named range", info.Template, appsTablePlaceholder)
+	}
 
-	// Height of 2nd row
-	err = f.SetRowHeight(SheetName, 2, 25)
+	// Report name, time range, team...
+	if err := fillPlaceholders(f, templateValues(appsdetails, info)); err != nil {
+		return err
+	}
 
-	// Merge cells for B2 header
-	err = f.MergeCell(SheetName, "B2", "D2")
+	// Main table with data
+	column, startRow, err := writeTemplateTable(f, sheet, cell, columns, reportData)
+	if err != nil {
+		return err
+	}
 
-	// Styling and font of B2 header
-	style, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Size: 20, Color: "6d64e8"}})
-	err = f.SetCellStyle(SheetName, "B2", "D2", style)
+	// Red/amber/green fills and data bars
+	if err := addThresholdFormats(f, sheet, columns, column, startRow, startRow+len(reportData)-1, info.Thresholds); err != nil {
+		return err
+	}
 
-	// Add value (B2 header)
-	err = f.SetSheetRow(SheetName, "B2", &[]interface{}{b2})
+	// Charts of the main table and custom metric series
+	if err := addChartsSheet(f, appsdetails, info); err != nil {
+		return err
+	}
 
-	// Merge cells for B3 header
-	err = f.MergeCell(SheetName, "B3", "D3")
+	// Tiers and nodes of every app on their own sheet
+	if err := addTiersSheet(f, appsdetails); err != nil {
+		return err
+	}
 
-	// Add value (B3 header)
-	err = f.SetSheetRow(SheetName, "B3", &[]interface{}{b3})
+	// Business transactions of every app on their own sheet
+	if err := addTransactionsSheet(f, appsdetails); err != nil {
+		return err
+	}
 
-	// Merge cells for B4 header
-	err = f.MergeCell(SheetName, "B4", "D4")
+	// Backends of every app and the ones shared between apps
+	if err := addBackendsSheets(f, appsdetails); err != nil {
+		return err
+	}
 
-	// Add value (B4 header)
-	err = f.SetSheetRow(SheetName, "B4", &[]interface{}{b4})
+	// Health rule violations of every app on their own sheet
+	if err := addViolationsSheet(f, appsdetails); err != nil {
+		return err
+	}
 
-	// Styling and font of B5 header
-	style, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Color: "666666"}})
-	err = f.MergeCell(SheetName, "B5", "D5")
-	err = f.SetCellStyle(SheetName, "B5", "D5", style)
+	// Health rules of every app with their conditions, when fetched
+	if info.HealthRuleDetails {
+		if err := addHealthRulesSheet(f, appsdetails); err != nil {
+			return err
+		}
+	}
 
-	// Add value (B5 header)
-	err = f.SetSheetRow(SheetName, "B5", &[]interface{}{b5})
+	// Health rules routed to notifications or not
+	if err := addCoverageSheet(f, appsdetails); err != nil {
+		return err
+	}
 
-	// Styling and font of report name
-	style, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Size: 32, Color: "2B4492", Bold: true}})
-	err = f.MergeCell(SheetName, "B7", "G7")
-	err = f.SetCellStyle(SheetName, "B7", "G7", style)
+	// Custom metric time series, if any
+	if err := addMetricSeriesSheet(f, appsdetails); err != nil {
+		return err
+	}
 
-	// Add value (report name)
-	err = f.SetSheetRow(SheetName, "B7", &[]interface{}{reportName})
+	// Agents out of policy, when the agent version audit ran
+	if agentsAudited(appsdetails) {
+		if err := addComplianceSheet(f, appsdetails); err != nil {
+			return err
+		}
+	}
 
-	// Styling and font of report subtitle
-	style, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Size: 13, Color: "E25184", Bold: true}})
-	err = f.MergeCell(SheetName, "B8", "C8")
-	err = f.SetCellStyle(SheetName, "B8", "C8", style)
+	return f.SaveAs(info.Profile + ".xlsx")
 
-	// Add value (report subtitle)
-	err = f.SetSheetRow(SheetName, "B8", &[]interface{}{reportSubtitle})
+}
 
-	// Styling and font of section names for timerange and scope
-	style, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Size: 13, Bold: true}})
-	err = f.SetCellStyle(SheetName, "B10", "G10", style)
+// addBrandingHeader writes the B2:B5 branding header of a sheet, each line
+// merged over columns B to D.
+func addBrandingHeader(f *excelize.File, sheet string, info ReportInfo) error {
 
-	// Add value (section names for timerange and scope)
-	err = f.SetSheetRow(SheetName, "B10", &[]interface{}{"From", "", "Until", "", "Scope"})
+	// Height of 2nd row
+	if err := f.SetRowHeight(sheet, 2, 25); err != nil {
+		return err
+	}
 
-	// Merge cells for section names (timerange and scope)
-	err = f.MergeCell(SheetName, "B10", "C10")
-	err = f.MergeCell(SheetName, "D10", "E10")
-	err = f.MergeCell(SheetName, "F10", "G10")
+	// Merge cells for B2:B5 headers
+	for row := 2; row <= 5; row++ {
+		if err := f.MergeCell(sheet, fmt.Sprintf("B%d", row), fmt.Sprintf("D%d", row)); err != nil {
+			return err
+		}
+	}
 
-	// Styling and font of section values for timerange and scope
+	// Styling and font of B2 header
+	style, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Size: 20, Color: "6d64e8"}})
+	if err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(sheet, "B2", "D2", style); err != nil {
+		return err
+	}
+
+	// Styling and font of B5 header
 	style, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Color: "666666"}})
-	err = f.SetCellStyle(SheetName, "B11", "G11", style)
+	if err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(sheet, "B5", "D5", style); err != nil {
+		return err
+	}
 
-	// Add values (timerange and scope)
-	err = f.SetSheetRow(SheetName, "B11", &[]interface{}{timeRangeStart, "", timeRangeEnd, "", scope})
+	// Add values (B2:B5 headers)
+	for row, value := range map[int]string{2: info.B2, 3: info.B3, 4: info.B4, 5: info.B5} {
+		if err := f.SetCellValue(sheet, fmt.Sprintf("B%d", row), value); err != nil {
+			return err
+		}
+	}
 
-	// Merge cells for section values (timerange and scope)
-	err = f.MergeCell(SheetName, "B11", "C11")
-	err = f.MergeCell(SheetName, "D11", "E11")
-	err = f.MergeCell(SheetName, "F11", "G11")
+	return nil
 
-	// Styling and font of section names for team and description
-	style, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Size: 13, Bold: true}})
-	err = f.SetCellStyle(SheetName, "B13", "G13", style)
+}
+
+// mainTableColumns returns the columns of the main table: the selected ones,
+// else the default ones, with a Health column after the first one when there
+// are thresholds.
+func mainTableColumns(info ReportInfo) []appd.Column {
+
+	// Main table columns, the default ones when not selected
+	columns := info.Columns
+	if len(columns) == 0 {
+		var metrics []appd.CustomMetric
+		for _, name := range info.CustomMetrics {
+			metrics = append(metrics, appd.CustomMetric{Name: name})
+		}
+		columns = appd.DefaultColumns(metrics)
+	}
 
-	// Add value (section names for team and description)
-	err = f.SetSheetRow(SheetName, "B13", &[]interface{}{"Team", "", "Description"})
+	// Health of every app right after the first column, when there are thresholds
+	if info.Thresholds.set() {
+		columns = append([]appd.Column{columns[0], healthColumn(info.Thresholds)}, columns[1:]...)
+	}
 
-	// Merge cells for section names (team and description)
-	err = f.MergeCell(SheetName, "B13", "C13")
-	err = f.MergeCell(SheetName, "D13", "E13")
+	return columns
 
-	// Styling and font of section values for team and description
-	style, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Color: "666666"}})
-	err = f.SetCellStyle(SheetName, "B14", "G14", style)
+}
 
-	// Add values (team and description)
-	err = f.SetSheetRow(SheetName, "B14", &[]interface{}{team, "", description})
+// mainTableRows returns the main table lines of the given apps.
+func mainTableRows(appsdetails []appd.AppDetails, columns []appd.Column) [][]interface{} {
 
-	// Merge cells for section values (team and description)
-	err = f.MergeCell(SheetName, "B14", "C14")
-	err = f.MergeCell(SheetName, "D14", "E14")
+	reportData := [][]interface{}{}
 
 	// Attach extracted apps details to []interface{}
 	for i := range appsdetails {
@@ -166,77 +238,16 @@ func BuildExcelReport(
 		app := appsdetails[i]
 
 		// Create the individual app record
-		s := []interface{}{
-			app.Name,
-			app.Metrics.NumberOfErrors,
-			app.Metrics.NumberOfCalls,
-			app.Metrics.NumberOfActiveHealthRules,
-			app.Metrics.NumberOfInactiveHealthRules}
+		s := make([]interface{}, len(columns))
+		for j, column := range columns {
+			s[j] = column.Value(app)
+		}
 
 		// Attach to all
 		reportData = append(reportData, s)
 
 	}
 
-	// Styling and font of table column names for main table with data
-	style, err = f.NewStyle(&excelize.Style{
-		Font:      &excelize.Font{Size: 13, Bold: true, Color: "2B4492"},
-		Alignment: &excelize.Alignment{Vertical: "center"},
-	})
-	err = f.SetCellStyle(SheetName, "B17", "G17", style)
-
-	// Table column names
-	err = f.SetSheetRow(SheetName, "B17", &[]interface{}{"Application", "Number of Errors", "Number of Calls", "Enabled Alerts", "Disabled Alerts"})
-
-	//err = f.MergeCell(SheetName, "D17", "E17")
-
-	// Height of table column names row
-	err = f.SetRowHeight(SheetName, 17, 32)
-
-	// We start inserting actual table data from row 18
-	startRow := 18
-
-	// Start iterating through subsequent rows
-	// For each row insert one line of the []interface{} app statistics data (essentially one app)
-	for i := startRow; i < (len(reportData) + startRow); i++ {
-
-		var fill string
-		if i%2 == 0 {
-			fill = "F3F3F3"
-		} else {
-			fill = "FFFFFF"
-		}
-
-		// Set styling and font for each table row
-		style, err = f.NewStyle(&excelize.Style{
-			Fill:      excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{fill}},
-			Font:      &excelize.Font{Color: "666666"},
-			Alignment: &excelize.Alignment{Vertical: "center"},
-		})
-		err = f.SetCellStyle(SheetName, fmt.Sprintf("B%d", i), fmt.Sprintf("F%d", i), style)
-
-		// Add row data
-		err = f.SetSheetRow(SheetName, fmt.Sprintf("B%d", i), &reportData[i-18])
-
-		/*
-			// Add actual data
-			err = f.SetCellRichText(SheetName, fmt.Sprintf("C%d", i), []excelize.RichTextRun{
-				{
-					Text: reportData[i-18][1].(string),
-					Font: &excelize.Font{
-						Bold: true}},
-			})*/
-
-		//err = f.MergeCell(SheetName, fmt.Sprintf("D%d", i), fmt.Sprintf("E%d", i))
-		// Set row height
-		err = f.SetRowHeight(SheetName, i, 18)
-
-	}
-
-	err = f.SaveAs(profile + ".xlsx")
-	if err != nil {
-		fmt.Println(err)
-	}
+	return reportData
 
-	return nil
 }
@@ -0,0 +1,273 @@
+package report
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+// inTempDir runs the test from a temporary directory, where the reports
+// are written.
+func inTempDir(t *testing.T) {
+
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+}
+
+// lookupColumns returns the registered columns of the given keys.
+func lookupColumns(t *testing.T, keys ...string) []appd.Column {
+
+	t.Helper()
+
+	var columns []appd.Column
+	for _, key := range keys {
+		column, ok := appd.LookupColumn(key)
+		if !ok {
+			t.Fatalf("unknown column %q", key)
+		}
+		columns = append(columns, column)
+	}
+
+	return columns
+
+}
+
+// openWorkbook opens a generated report, closed at the end of the test.
+func openWorkbook(t *testing.T, filename string) *excelize.File {
+
+	t.Helper()
+
+	f, err := excelize.OpenFile(filename)
+	if err != nil {
+		t.Fatalf("couldn't open %v: %v", filename, err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return f
+
+}
+
+// checkRow compares the raw values of a sheet row from column B on.
+func checkRow(t *testing.T, f *excelize.File, sheet string, row int, want ...string) {
+
+	t.Helper()
+
+	for i, value := range want {
+
+		cell, _ := excelize.CoordinatesToCellName(2+i, row)
+
+		got, err := f.GetCellValue(sheet, cell, excelize.Options{RawCellValue: true})
+		if err != nil {
+			t.Fatalf("%v!%v: %v", sheet, cell, err)
+		}
+		if got != value {
+			t.Errorf("%v!%v = %q, want %q", sheet, cell, got, value)
+		}
+
+	}
+
+}
+
+func testApps() []appd.AppDetails {
+	return []appd.AppDetails{
+		{
+			Name:       "ecommerce-web",
+			Id:         11,
+			Controller: "prod",
+			Metrics:    appd.AppMetrics{NumberOfCalls: 1000, NumberOfErrors: 10, NumberOfActiveHealthRules: 3},
+		},
+		{
+			Name:       "legacy-batch",
+			Id:         15,
+			Controller: "prod",
+			Failures:   []string{appd.FetchHealthRules + ": timeout"},
+		},
+	}
+}
+
+func TestBuildExcelReport(t *testing.T) {
+
+	inTempDir(t)
+
+	info := ReportInfo{
+		Profile:        "prod",
+		Name:           "Weekly Report",
+		TimeRangeStart: "2024-01-01",
+		TimeRangeEnd:   "2024-01-08",
+		B2:             "ACME",
+		Columns:        lookupColumns(t, "application", "calls", "enabledalerts", "collectionerrors"),
+		Thresholds:     Thresholds{NoHealthRules: SeverityCritical},
+	}
+
+	if err := BuildExcelReport(testApps(), info); err != nil {
+		t.Fatalf("BuildExcelReport: %v", err)
+	}
+
+	f := openWorkbook(t, "prod.xlsx")
+
+	// Health Rules sheet only with the health rule details
+	sheets := map[string]bool{}
+	for _, sheet := range f.GetSheetList() {
+		sheets[sheet] = true
+	}
+	for _, sheet := range []string{SheetName, ChartsSheetName, TiersSheetName, ViolationsSheetName, CoverageSheetName} {
+		if !sheets[sheet] {
+			t.Errorf("missing sheet %q, got %v", sheet, f.GetSheetList())
+		}
+	}
+	if sheets[HealthRulesSheetName] {
+		t.Errorf("got a %q sheet without the health rule details", HealthRulesSheetName)
+	}
+
+	// Placeholders filled
+	checkRow(t, f, SheetName, 2, "ACME")
+	checkRow(t, f, SheetName, 7, "Weekly Report")
+	checkRow(t, f, SheetName, 11, "2024-01-01")
+	if until, _ := f.GetCellValue(SheetName, "D11"); until != "2024-01-08" {
+		t.Errorf("%v!D11 = %q, want 2024-01-08", SheetName, until)
+	}
+
+	// Main table, with the Health column after the first one and the
+	// values that couldn't be fetched left empty
+	checkRow(t, f, SheetName, 17, "Application", "Health", "Number of Calls", "Enabled Alerts", "Collection Errors")
+	checkRow(t, f, SheetName, 18, "ecommerce-web", fmt.Sprint(healthOK), "1000", "3", "")
+	checkRow(t, f, SheetName, 19, "legacy-batch", fmt.Sprint(healthOK), "0", "", "health rules: timeout")
+
+	// Health levels shown by name, whatever the other levels in the column
+	for _, cell := range []string{"C18", "C19"} {
+		style, err := f.GetCellStyle(SheetName, cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := f.GetStyle(style); err != nil || got.CustomNumFmt == nil || *got.CustomNumFmt != healthFormat {
+			t.Errorf("%v!%v number format isn't %v (%v)", SheetName, cell, healthFormat, err)
+		}
+	}
+
+	// Coverage unknown without the health rules
+	checkRow(t, f, CoverageSheetName, 5, "ecommerce-web", "0", "0", "0", "0", "", "No")
+	checkRow(t, f, CoverageSheetName, 6, "legacy-batch", "", "", "0", "0", "", "Unknown")
+
+}
+
+func TestBuildExcelReportHealthRules(t *testing.T) {
+
+	inTempDir(t)
+
+	apps := testApps()
+	apps[0].Alerting = []appd.AppHealthRules{{Name: "CPU", Id: 1, Active: true}}
+
+	info := ReportInfo{Profile: "prod", HealthRuleDetails: true}
+
+	if err := BuildExcelReport(apps, info); err != nil {
+		t.Fatalf("BuildExcelReport: %v", err)
+	}
+
+	f := openWorkbook(t, "prod.xlsx")
+
+	if index, _ := f.GetSheetIndex(HealthRulesSheetName); index < 0 {
+		t.Errorf("missing sheet %q, got %v", HealthRulesSheetName, f.GetSheetList())
+	}
+
+}
+
+func TestBuildConsolidatedReport(t *testing.T) {
+
+	inTempDir(t)
+
+	staging := []appd.AppDetails{{
+		Name:       "search-service",
+		Id:         16,
+		Controller: "staging",
+		Metrics:    appd.AppMetrics{NumberOfCalls: 50, NumberOfErrors: 1},
+	}}
+
+	reports := []ControllerReport{
+		{Info: ReportInfo{Profile: "prod", Columns: lookupColumns(t, "application", "calls")}, Apps: testApps()},
+		{Info: ReportInfo{Profile: "staging", Columns: lookupColumns(t, "application", "errors")}, Apps: staging},
+	}
+
+	if err := BuildConsolidatedReport("all", "", reports); err != nil {
+		t.Fatalf("BuildConsolidatedReport: %v", err)
+	}
+
+	f := openWorkbook(t, "all.xlsx")
+
+	want := []string{OverviewSheetName, AllAppsSheetName, "prod", "staging"}
+	if got := f.GetSheetList(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sheets = %v, want %v", got, want)
+	}
+
+	// Every column of any controller, empty for the others
+	checkRow(t, f, AllAppsSheetName, 4, "Controller", "Application", "Number of Calls", "Number of Errors")
+	checkRow(t, f, AllAppsSheetName, 5, "prod", "ecommerce-web", "1000", "")
+	checkRow(t, f, AllAppsSheetName, 6, "prod", "legacy-batch", "0", "")
+	checkRow(t, f, AllAppsSheetName, 7, "staging", "search-service", "", "1")
+
+}
+
+func TestThresholdsValidate(t *testing.T) {
+
+	for _, test := range []struct {
+		thresholds Thresholds
+		valid      bool
+	}{
+		{Thresholds{}, true},
+		{Thresholds{ErrorRate: Threshold{Warning: 1, Critical: 5}, NoHealthRules: SeverityWarning}, true},
+		{Thresholds{ResponseTime: Threshold{Critical: -1}}, false},
+		{Thresholds{NoHealthRules: "high"}, false},
+		{Thresholds{ErrorRate: Threshold{Warning: 5, Critical: 1}}, false},
+		{Thresholds{ResponseTime: Threshold{Warning: 2000, Critical: 1000}}, false},
+		{Thresholds{ResponseTime: Threshold{Warning: 2000}}, true},
+	} {
+
+		err := test.thresholds.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: Validate() = %v, want valid %v", test.thresholds, err, test.valid)
+		}
+
+	}
+
+}
+
+func TestPerformanceSeriesCharts(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	apps := testApps()
+	apps[0].PerformanceSeries = []appd.CustomMetricValue{{
+		Name:        "Calls per Minute",
+		Aggregation: appd.AggregateAverage,
+		Series: []appd.MetricSeries{{Points: []appd.MetricPoint{
+			{Time: start, Value: 10},
+			{Time: start.Add(time.Hour), Value: 12},
+		}}},
+	}}
+
+	chart := metricSeriesChart(apps, 10, "Calls per Minute", performanceSeries)
+	if len(chart.Rows) != 2 || len(chart.Columns) != 2 || chart.Columns[1].Name != "ecommerce-web" {
+		t.Fatalf("got columns %v and rows %v, want ecommerce-web at 2 times", chart.Columns, chart.Rows)
+	}
+	if chart.Rows[1][1] != 12.0 {
+		t.Errorf("got %v at %v, want 12", chart.Rows[1][1], chart.Rows[1][0])
+	}
+
+	// Custom metrics of the same name aren't mixed in
+	if chart := metricSeriesChart(apps, 10, "Calls per Minute", customMetrics); len(chart.Rows) != 0 {
+		t.Errorf("got custom metric rows %v", chart.Rows)
+	}
+
+}
@@ -0,0 +1,128 @@
+package report
+
+import (
+	"fmt"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// tableColumn is one column of a detail sheet table.
+type tableColumn struct {
+	Name  string
+	Width float64
+}
+
+// newDetailSheet adds a sheet with a title in B2 and the given table: column
+// names on row 4 and one row per entry of rows from row 5, styled like the
+// main table. Column A is left as a margin.
+func newDetailSheet(f *excelize.File, sheet string, title string, columns []tableColumn, rows [][]interface{}) error {
+
+	if _, err := f.NewSheet(sheet); err != nil {
+		return err
+	}
+
+	// Left margin
+	if err := f.SetColWidth(sheet, "A", "A", 6); err != nil {
+		return err
+	}
+
+	// Styling and font of sheet title
+	style, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Size: 20, Color: "2B4492", Bold: true}})
+	if err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(sheet, "B2", "B2", style); err != nil {
+		return err
+	}
+
+	// Add value (sheet title)
+	if err := f.SetCellValue(sheet, "B2", title); err != nil {
+		return err
+	}
+	if err := f.SetRowHeight(sheet, 2, 30); err != nil {
+		return err
+	}
+
+	return writeTable(f, sheet, 4, columns, rows)
+
+}
+
+// writeTable writes column names on headerRow and rows below it, starting
+// at column B.
+func writeTable(f *excelize.File, sheet string, headerRow int, columns []tableColumn, rows [][]interface{}) error {
+
+	if len(columns) == 0 {
+		return nil
+	}
+
+	// Last column of the table
+	last, err := excelize.ColumnNumberToName(len(columns) + 1)
+	if err != nil {
+		return err
+	}
+
+	// Column widths and names
+	names := make([]interface{}, len(columns))
+	for i, column := range columns {
+
+		name, _ := excelize.ColumnNumberToName(i + 2)
+		if err := f.SetColWidth(sheet, name, name, column.Width); err != nil {
+			return err
+		}
+		names[i] = column.Name
+
+	}
+
+	// Styling and font of table column names
+	style, err := f.NewStyle(&excelize.Style{
+		Font:      &excelize.Font{Size: 13, Bold: true, Color: "2B4492"},
+		Alignment: &excelize.Alignment{Vertical: "center"},
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(sheet, fmt.Sprintf("B%d", headerRow), fmt.Sprintf("%v%d", last, headerRow), style); err != nil {
+		return err
+	}
+
+	// Table column names
+	if err := f.SetSheetRow(sheet, fmt.Sprintf("B%d", headerRow), &names); err != nil {
+		return err
+	}
+	if err := f.SetRowHeight(sheet, headerRow, 32); err != nil {
+		return err
+	}
+
+	// Alternate row fills, as on the main table
+	var fills [2]int
+	for i, fill := range []string{"F3F3F3", "FFFFFF"} {
+		fills[i], err = f.NewStyle(&excelize.Style{
+			Fill:      excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{fill}},
+			Font:      &excelize.Font{Color: "666666"},
+			Alignment: &excelize.Alignment{Vertical: "center"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// One line per row
+	for i := range rows {
+
+		row := headerRow + 1 + i
+
+		if err := f.SetCellStyle(sheet, fmt.Sprintf("B%d", row), fmt.Sprintf("%v%d", last, row), fills[row%2]); err != nil {
+			return err
+		}
+		if err := f.SetSheetRow(sheet, fmt.Sprintf("B%d", row), &rows[i]); err != nil {
+			return err
+		}
+		if err := f.SetRowHeight(sheet, row, 18); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
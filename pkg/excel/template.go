@@ -0,0 +1,510 @@
+package report
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+// appsTablePlaceholder marks the top left cell of the main table: its column
+// names go there, styled as the placeholder cell, and its lines below,
+// styled as the two cells under the placeholder (alternating).
+const appsTablePlaceholder = "table.apps"
+
+// brandingPlaceholders lays out the branding header (see addBrandingHeader)
+// with placeholders, filled with the B2:B5 report details.
+var brandingPlaceholders = ReportInfo{
+	B2: "{{header.b2}}",
+	B3: "{{header.b3}}",
+	B4: "{{header.b4}}",
+	B5: "{{header.b5}}",
+}
+
+// placeholderPattern matches {{key}} placeholders in template cells.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.]+)\s*\}\}`)
+
+// defaultTemplate returns the built-in report layout for a main table of the
+// given number of columns, with placeholders in place of the report details.
+func defaultTemplate(columns int) (*excelize.File, error) {
+
+	// Create file
+	f := excelize.NewFile()
+
+	if err := layoutDefaultTemplate(f, columns); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+
+}
+
+// layoutDefaultTemplate lays out the built-in report in a new file.
+func layoutDefaultTemplate(f *excelize.File, columns int) error {
+
+	// Select default spreadsheet and rename
+	index, err := f.NewSheet("Sheet1")
+	if err != nil {
+		return err
+	}
+
+	// Select active sheet
+	f.SetActiveSheet(index)
+
+	// Rename active sheet
+	if err := f.SetSheetName("Sheet1", SheetName); err != nil {
+		return err
+	}
+
+	// Last column of the main table, and the right margin after it
+	lastColumn, err := excelize.ColumnNumberToName(columns + 1)
+	if err != nil {
+		return err
+	}
+	marginColumn, err := excelize.ColumnNumberToName(columns + 2)
+	if err != nil {
+		return err
+	}
+
+	// Set column width
+	for _, width := range []struct {
+		from, to string
+		width    float64
+	}{
+		{"A", "A", 6},
+		{marginColumn, marginColumn, 6},
+		{"B", "B", 30},
+		{"C", lastColumn, 20},
+	} {
+		if err := f.SetColWidth(SheetName, width.from, width.to, width.width); err != nil {
+			return err
+		}
+	}
+
+	// Height of 1st row
+	if err := f.SetRowHeight(SheetName, 1, 12); err != nil {
+		return err
+	}
+
+	// Merge 1st row cells
+	if err := f.MergeCell(SheetName, "A1", marginColumn+"1"); err != nil {
+		return err
+	}
+
+	// Branding header (B2:B5)
+	if err := addBrandingHeader(f, SheetName, brandingPlaceholders); err != nil {
+		return err
+	}
+
+	// Text lines: report name, subtitle and incomplete marker right under it,
+	// section names and values for timerange, scope, team and description
+	for _, line := range []struct {
+		cell   string
+		last   string
+		style  excelize.Font
+		values []interface{}
+		merges [][2]string
+	}{
+		{"B7", "G7", excelize.Font{Size: 32, Color: "2B4492", Bold: true}, []interface{}{"{{report.name}}"}, [][2]string{{"B7", "G7"}}},
+		{"B8", "C8", excelize.Font{Size: 13, Color: "E25184", Bold: true}, []interface{}{"{{report.subtitle}}"}, [][2]string{{"B8", "C8"}}},
+		{"B9", "G9", excelize.Font{Size: 13, Color: "D0021B", Bold: true}, []interface{}{"{{report.incomplete}}"}, [][2]string{{"B9", "G9"}}},
+		{"B10", "G10", excelize.Font{Size: 13, Bold: true}, []interface{}{"From", "", "Until", "", "Scope"}, [][2]string{{"B10", "C10"}, {"D10", "E10"}, {"F10", "G10"}}},
+		{"B11", "G11", excelize.Font{Color: "666666"}, []interface{}{"{{report.from}}", "", "{{report.until}}", "", "{{report.scope}}"}, [][2]string{{"B11", "C11"}, {"D11", "E11"}, {"F11", "G11"}}},
+		{"B13", "G13", excelize.Font{Size: 13, Bold: true}, []interface{}{"Team", "", "Description"}, [][2]string{{"B13", "C13"}, {"D13", "E13"}}},
+		{"B14", "G14", excelize.Font{Color: "666666"}, []interface{}{"{{report.team}}", "", "{{report.description}}"}, [][2]string{{"B14", "C14"}, {"D14", "E14"}}},
+	} {
+
+		// Styling and font
+		font := line.style
+		style, err := f.NewStyle(&excelize.Style{Font: &font})
+		if err != nil {
+			return err
+		}
+		if err := f.SetCellStyle(SheetName, line.cell, line.last, style); err != nil {
+			return err
+		}
+
+		// Add values
+		if err := f.SetSheetRow(SheetName, line.cell, &line.values); err != nil {
+			return err
+		}
+
+		// Merge cells
+		for _, merge := range line.merges {
+			if err := f.MergeCell(SheetName, merge[0], merge[1]); err != nil {
+				return err
+			}
+		}
+
+	}
+
+	// Styling and font of table column names for main table with data
+	style, err := f.NewStyle(&excelize.Style{
+		Font:      &excelize.Font{Size: 13, Bold: true, Color: "2B4492"},
+		Alignment: &excelize.Alignment{Vertical: "center"},
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(SheetName, "B17", lastColumn+"17", style); err != nil {
+		return err
+	}
+
+	// Main table placeholder
+	if err := f.SetSheetRow(SheetName, "B17", &[]interface{}{"{{" + appsTablePlaceholder + "}}"}); err != nil {
+		return err
+	}
+
+	// Height of table column names row
+	if err := f.SetRowHeight(SheetName, 17, 32); err != nil {
+		return err
+	}
+
+	// Alternating styles of the table rows, data starts from row 18
+	for i, fill := range []string{"F3F3F3", "FFFFFF"} {
+
+		style, err := f.NewStyle(&excelize.Style{
+			Fill:      excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{fill}},
+			Font:      &excelize.Font{Color: "666666"},
+			Alignment: &excelize.Alignment{Vertical: "center"},
+		})
+		if err != nil {
+			return err
+		}
+		if err := f.SetCellStyle(SheetName, fmt.Sprintf("B%d", 18+i), fmt.Sprintf("%v%d", lastColumn, 18+i), style); err != nil {
+			return err
+		}
+
+		// Set row height
+		if err := f.SetRowHeight(SheetName, 18+i, 18); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// templateValues returns the values of the report placeholders.
+func templateValues(appsdetails []appd.AppDetails, info ReportInfo) map[string]interface{} {
+
+	// Apps without statistics are left out of the totals
+	var calls, errors int64
+	for _, app := range appsdetails {
+		if !app.HasStats() {
+			continue
+		}
+		calls += app.Metrics.NumberOfCalls
+		errors += app.Metrics.NumberOfErrors
+	}
+
+	incomplete := ""
+	if info.Incomplete != "" {
+		incomplete = "INCOMPLETE REPORT - " + info.Incomplete
+	}
+
+	return map[string]interface{}{
+		"report.name":         info.Name,
+		"report.subtitle":     info.Subtitle,
+		"report.from":         info.TimeRangeStart,
+		"report.until":        info.TimeRangeEnd,
+		"report.scope":        info.Scope,
+		"report.team":         info.Team,
+		"report.description":  info.Description,
+		"report.controller":   info.ControllerURL,
+		"report.profile":      info.Profile,
+		"report.incomplete":   incomplete,
+		"report.applications": len(appsdetails),
+		"totals.calls":        calls,
+		"totals.errors":       errors,
+		"header.b2":           info.B2,
+		"header.b3":           info.B3,
+		"header.b4":           info.B4,
+		"header.b5":           info.B5,
+	}
+
+}
+
+// fillPlaceholders replaces the {{key}} placeholders found in the cells of
+// every sheet, and writes the value of every named range called after a key
+// to its first cell. A cell holding a single placeholder takes the type of
+// the value (eg numbers stay numbers). Unknown keys are left as they are.
+func fillPlaceholders(f *excelize.File, values map[string]interface{}) error {
+
+	for _, sheet := range f.GetSheetList() {
+		if err := fillSheetPlaceholders(f, sheet, values); err != nil {
+			return err
+		}
+	}
+
+	// Named ranges
+	for _, name := range f.GetDefinedName() {
+
+		value, ok := values[name.Name]
+		if !ok {
+			continue
+		}
+
+		sheet, cell, ok := definedNameCell(name.RefersTo)
+		if !ok {
+			continue
+		}
+
+		if err := f.SetCellValue(sheet, cell, value); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// fillSheetPlaceholders replaces the {{key}} placeholders found in the cells
+// of a sheet, see fillPlaceholders.
+func fillSheetPlaceholders(f *excelize.File, sheet string, values map[string]interface{}) error {
+
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return err
+	}
+
+	for r, row := range rows {
+
+		for c, text := range row {
+
+			if !strings.Contains(text, "{{") {
+				continue
+			}
+
+			cell, err := excelize.CoordinatesToCellName(c+1, r+1)
+			if err != nil {
+				return err
+			}
+
+			// Single placeholder
+			if key, ok := placeholderKey(text); ok {
+				if value, ok := values[key]; ok {
+					if err := f.SetCellValue(sheet, cell, value); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			// Placeholders within text
+			filled := placeholderPattern.ReplaceAllStringFunc(text, func(match string) string {
+				key := placeholderPattern.FindStringSubmatch(match)[1]
+				if value, ok := values[key]; ok {
+					return fmt.Sprint(value)
+				}
+				return match
+			})
+			if filled != text {
+				if err := f.SetCellValue(sheet, cell, filled); err != nil {
+					return err
+				}
+			}
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// findPlaceholder returns the sheet and cell holding the {{key}}
+// placeholder, else the first cell of the named range called key. sheet is
+// "" when there is neither.
+func findPlaceholder(f *excelize.File, key string) (sheet string, cell string, err error) {
+
+	for _, sheet := range f.GetSheetList() {
+
+		rows, err := f.GetRows(sheet)
+		if err != nil {
+			return "", "", err
+		}
+
+		for r, row := range rows {
+			for c, text := range row {
+				if found, ok := placeholderKey(text); ok && found == key {
+					cell, err := excelize.CoordinatesToCellName(c+1, r+1)
+					return sheet, cell, err
+				}
+			}
+		}
+
+	}
+
+	for _, name := range f.GetDefinedName() {
+		if name.Name == key {
+			if sheet, cell, ok := definedNameCell(name.RefersTo); ok {
+				return sheet, cell, nil
+			}
+		}
+	}
+
+	return "", "", nil
+
+}
+
+// placeholderKey returns the key of a cell holding a single placeholder.
+func placeholderKey(text string) (string, bool) {
+
+	match := placeholderPattern.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil || match[0] != strings.TrimSpace(text) {
+		return "", false
+	}
+
+	return match[1], true
+
+}
+
+// definedNameCell returns the sheet and first cell a named range refers to,
+// eg "'Report'!$B$7:$G$7".
+func definedNameCell(refersTo string) (sheet string, cell string, ok bool) {
+
+	ref := strings.TrimPrefix(refersTo, "=")
+
+	i := strings.LastIndex(ref, "!")
+	if i < 0 {
+		return "", "", false
+	}
+
+	sheet = ref[:i]
+	if strings.HasPrefix(sheet, "'") && strings.HasSuffix(sheet, "'") {
+		sheet = strings.ReplaceAll(sheet[1:len(sheet)-1], "''", "'")
+	}
+
+	cell = strings.ReplaceAll(strings.SplitN(ref[i+1:], ":", 2)[0], "$", "")
+	if _, _, err := excelize.CellNameToCoordinates(cell); err != nil {
+		return "", "", false
+	}
+
+	return sheet, cell, true
+
+}
+
+// writeTemplateTable writes a table at cell: column names styled as the
+// cell, and one line per row below, styled as the two cells under it
+// (alternating) with the number formats of the columns, and as high as the
+// first line. Returns the column number of cell and the first line of data.
+func writeTemplateTable(f *excelize.File, sheet string, cell string, columns []appd.Column, rows [][]interface{}) (int, int, error) {
+
+	col, row, err := excelize.CellNameToCoordinates(cell)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	first, err := excelize.ColumnNumberToName(col)
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := excelize.ColumnNumberToName(col + len(columns) - 1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Styles from the template
+	header, err := f.GetCellStyle(sheet, cell)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var fills [2]int
+	for i := range fills {
+		if fills[i], err = f.GetCellStyle(sheet, fmt.Sprintf("%v%d", first, row+1+i)); err != nil {
+			return 0, 0, err
+		}
+	}
+	if fills[1] == 0 {
+		fills[1] = fills[0]
+	}
+
+	height, err := f.GetRowHeight(sheet, row+1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Line styles with the number format of every column
+	formats := make([][2]int, len(columns))
+	for i, column := range columns {
+		for j, fill := range fills {
+			if formats[i][j], err = withNumberFormat(f, fill, column.Format); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	// Table column names
+	names := make([]interface{}, len(columns))
+	for i, column := range columns {
+		names[i] = column.Header
+	}
+	if err := f.SetCellStyle(sheet, cell, fmt.Sprintf("%v%d", last, row), header); err != nil {
+		return 0, 0, err
+	}
+	if err := f.SetSheetRow(sheet, cell, &names); err != nil {
+		return 0, 0, err
+	}
+
+	// Clear the sample lines, in case there are less rows
+	for i := 1; i <= 2; i++ {
+		if err := f.SetCellStyle(sheet, fmt.Sprintf("%v%d", first, row+i), fmt.Sprintf("%v%d", last, row+i), 0); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// For each row insert one line of the []interface{} app statistics data (essentially one app)
+	for i := range rows {
+
+		line := row + 1 + i
+
+		if err := f.SetCellStyle(sheet, fmt.Sprintf("%v%d", first, line), fmt.Sprintf("%v%d", last, line), fills[i%2]); err != nil {
+			return 0, 0, err
+		}
+		for j, column := range columns {
+			if column.Format == "" {
+				continue
+			}
+			formatted, _ := excelize.CoordinatesToCellName(col+j, line)
+			if err := f.SetCellStyle(sheet, formatted, formatted, formats[j][i%2]); err != nil {
+				return 0, 0, err
+			}
+		}
+		if err := f.SetSheetRow(sheet, fmt.Sprintf("%v%d", first, line), &rows[i]); err != nil {
+			return 0, 0, err
+		}
+		if err := f.SetRowHeight(sheet, line, height); err != nil {
+			return 0, 0, err
+		}
+
+	}
+
+	return col, row + 1, nil
+
+}
+
+// withNumberFormat returns a style like the given one with a custom number
+// format, the style itself when format is empty.
+func withNumberFormat(f *excelize.File, style int, format string) (int, error) {
+
+	if format == "" {
+		return style, nil
+	}
+
+	base, err := f.GetStyle(style)
+	if err != nil {
+		return 0, err
+	}
+
+	base.CustomNumFmt = &format
+
+	return f.NewStyle(base)
+
+}
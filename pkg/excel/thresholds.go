@@ -0,0 +1,305 @@
+package report
+
+import (
+	"fmt"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+// Health levels of an application, as written to the Health column of the
+// main table so an icon set can be drawn from them.
+const (
+	healthCritical = 0
+	healthWarning  = 1
+	healthOK       = 2
+)
+
+// healthColumnKey is the key of the Health column, see appd.Column.
+const healthColumnKey = "health"
+
+// healthFormat shows the health levels by name, the cells keeping the level
+// so the column sorts from critical to OK.
+var healthFormat = fmt.Sprintf(`[=%d]"Critical";[=%d]"Warning";"OK"`, healthCritical, healthWarning)
+
+// Severities of Thresholds.NoHealthRules.
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+)
+
+// Threshold is a warning and a critical level for a value, higher being
+// worse. A level of 0 is not checked.
+type Threshold struct {
+	Warning  float64
+	Critical float64
+}
+
+// Thresholds flag problem applications on the main table: ErrorRate is in
+// % of calls, ResponseTime in ms. NoHealthRules is the severity
+// (SeverityCritical or SeverityWarning) of apps without any enabled health
+// rule, "" to not flag them.
+type Thresholds struct {
+	ErrorRate     Threshold
+	ResponseTime  Threshold
+	NoHealthRules string
+}
+
+// Fills of the conditional formats, as Excel's built-in "light red fill with
+// dark red text" and the like.
+var (
+	criticalFill = excelize.Style{
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"FFC7CE"}},
+		Font: &excelize.Font{Color: "9C0006"},
+	}
+	warningFill = excelize.Style{
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"FFEB9C"}},
+		Font: &excelize.Font{Color: "9C5700"},
+	}
+	okFill = excelize.Style{
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"C6EFCE"}},
+		Font: &excelize.Font{Color: "006100"},
+	}
+)
+
+// set tells if any level of the threshold is checked.
+func (t Threshold) set() bool {
+	return t.Warning > 0 || t.Critical > 0
+}
+
+// set tells if any threshold is checked.
+func (t Thresholds) set() bool {
+	return t.ErrorRate.set() || t.ResponseTime.set() || t.NoHealthRules != ""
+}
+
+// Validate checks the thresholds are usable: levels aren't negative,
+// warning levels aren't above critical ones and NoHealthRules is a known
+// severity or "".
+func (t Thresholds) Validate() error {
+
+	if t.ErrorRate.Warning < 0 || t.ErrorRate.Critical < 0 {
+		return fmt.Errorf("negative error rate threshold")
+	}
+	if t.ResponseTime.Warning < 0 || t.ResponseTime.Critical < 0 {
+		return fmt.Errorf("negative response time threshold")
+	}
+
+	// A warning level over the critical one would never show
+	if t.ErrorRate.Warning > 0 && t.ErrorRate.Critical > 0 && t.ErrorRate.Warning > t.ErrorRate.Critical {
+		return fmt.Errorf("error rate warning threshold %v is above the critical one %v", t.ErrorRate.Warning, t.ErrorRate.Critical)
+	}
+	if t.ResponseTime.Warning > 0 && t.ResponseTime.Critical > 0 && t.ResponseTime.Warning > t.ResponseTime.Critical {
+		return fmt.Errorf("response time warning threshold %v is above the critical one %v", t.ResponseTime.Warning, t.ResponseTime.Critical)
+	}
+
+	switch t.NoHealthRules {
+	case "", SeverityCritical, SeverityWarning:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported severity %q for applications without health rules, use %v, %v or leave it empty", t.NoHealthRules, SeverityCritical, SeverityWarning)
+
+}
+
+// level returns the health level of value.
+func (t Threshold) level(value float64) int {
+
+	switch {
+	case t.Critical > 0 && value >= t.Critical:
+		return healthCritical
+	case t.Warning > 0 && value >= t.Warning:
+		return healthWarning
+	}
+
+	return healthOK
+
+}
+
+// healthColumn is the Health column of the main table.
+func healthColumn(t Thresholds) appd.Column {
+	return appd.Column{
+		Key:    healthColumnKey,
+		Header: "Health",
+		Format: healthFormat,
+		Value: func(app appd.AppDetails) interface{} {
+			return appHealth(app, t)
+		},
+	}
+}
+
+// appHealth returns the worst health level of an app against the thresholds,
+// leaving out the values that couldn't be fetched.
+func appHealth(app appd.AppDetails, t Thresholds) int {
+
+	health := healthOK
+
+	if rate, ok := app.Metrics.ErrorRate(); ok {
+		health = worst(health, t.ErrorRate.level(rate))
+	}
+
+	if app.Metrics.NumberOfCalls > 0 {
+		health = worst(health, t.ResponseTime.level(app.Metrics.AverageResponseTime))
+	}
+
+	// Not knowing the health rules of an app isn't the same as it having none
+	if app.Metrics.NumberOfActiveHealthRules == 0 && !app.Failed(appd.FetchHealthRules) {
+		switch t.NoHealthRules {
+		case SeverityCritical:
+			health = healthCritical
+		case SeverityWarning:
+			health = worst(health, healthWarning)
+		}
+	}
+
+	return health
+
+}
+
+// worst returns the worst of two health levels.
+func worst(a int, b int) int {
+
+	if b < a {
+		return b
+	}
+
+	return a
+
+}
+
+// addThresholdFormats adds the conditional formats of the main table, whose
+// columns start at column number firstColumn and whose data lines go from
+// first to last row:
+// red/amber/green fills on the Health column and on the values checked
+// against thresholds, and data bars on Number of Calls.
+func addThresholdFormats(f *excelize.File, sheet string, columns []appd.Column, firstColumn int, first int, last int, t Thresholds) error {
+
+	if last < first {
+		return nil
+	}
+
+	// Fills
+	var critical, warning, ok int
+	for _, fill := range []struct {
+		id    *int
+		style excelize.Style
+	}{
+		{&critical, criticalFill},
+		{&warning, warningFill},
+		{&ok, okFill},
+	} {
+		id, err := f.NewConditionalStyle(&fill.style)
+		if err != nil {
+			return err
+		}
+		*fill.id = id
+	}
+
+	// Range of a column of the main table and its first cell, as used in
+	// formulas (relative to the first row)
+	column := func(key string) (string, string) {
+		for i, c := range columns {
+			if c.Key == key {
+				letter, _ := excelize.ColumnNumberToName(firstColumn + i)
+				return fmt.Sprintf("%v%d:%v%d", letter, first, letter, last), fmt.Sprintf("%v%d", letter, first)
+			}
+		}
+		return "", ""
+	}
+
+	// Red/amber/green fills of values checked against a threshold
+	levels := func(key string, threshold Threshold) error {
+
+		ref, cell := column(key)
+		if ref == "" || !threshold.set() {
+			return nil
+		}
+
+		var rules []excelize.ConditionalFormatOptions
+
+		if threshold.Critical > 0 {
+			rules = append(rules, excelize.ConditionalFormatOptions{
+				Type:       "formula",
+				Criteria:   fmt.Sprintf("AND(ISNUMBER(%v),%v>=%v)", cell, cell, threshold.Critical),
+				Format:     critical,
+				StopIfTrue: true,
+			})
+		}
+
+		if threshold.Warning > 0 {
+			rules = append(rules, excelize.ConditionalFormatOptions{
+				Type:       "formula",
+				Criteria:   fmt.Sprintf("AND(ISNUMBER(%v),%v>=%v)", cell, cell, threshold.Warning),
+				Format:     warning,
+				StopIfTrue: true,
+			})
+		}
+
+		rules = append(rules, excelize.ConditionalFormatOptions{
+			Type:     "formula",
+			Criteria: fmt.Sprintf("ISNUMBER(%v)", cell),
+			Format:   ok,
+		})
+
+		return f.SetConditionalFormat(sheet, ref, rules)
+
+	}
+
+	if err := levels("errorrate", t.ErrorRate); err != nil {
+		return err
+	}
+	if err := levels("responsetime", t.ResponseTime); err != nil {
+		return err
+	}
+
+	// Apps without enabled health rules
+	if ref, cell := column("enabledalerts"); ref != "" && t.NoHealthRules != "" {
+
+		format := warning
+		if t.NoHealthRules == SeverityCritical {
+			format = critical
+		}
+
+		if err := f.SetConditionalFormat(sheet, ref, []excelize.ConditionalFormatOptions{{
+			Type:     "formula",
+			Criteria: fmt.Sprintf("AND(ISNUMBER(%v),%v=0)", cell, cell),
+			Format:   format,
+		}}); err != nil {
+			return err
+		}
+
+	}
+
+	// Health: fill of the level, named by the number format of the column.
+	// No icon set: excelize draws them relative to the column min and max,
+	// so a warning would show red on a sheet without critical apps
+	if ref, cell := column(healthColumnKey); ref != "" {
+
+		if err := f.SetConditionalFormat(sheet, ref, []excelize.ConditionalFormatOptions{
+			{Type: "formula", Criteria: fmt.Sprintf("%v=%d", cell, healthCritical), Format: critical},
+			{Type: "formula", Criteria: fmt.Sprintf("%v=%d", cell, healthWarning), Format: warning},
+			{Type: "formula", Criteria: fmt.Sprintf("%v=%d", cell, healthOK), Format: ok},
+		}); err != nil {
+			return err
+		}
+
+	}
+
+	// Data bars on calls
+	if ref, _ := column("calls"); ref != "" {
+
+		if err := f.SetConditionalFormat(sheet, ref, []excelize.ConditionalFormatOptions{{
+			Type:     "data_bar",
+			Criteria: "=",
+			MinType:  "min",
+			MaxType:  "max",
+			BarColor: "#638EC6",
+			BarSolid: true,
+		}}); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
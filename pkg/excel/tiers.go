@@ -0,0 +1,56 @@
+package report
+
+import (
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	TiersSheetName = "Tiers & Nodes"
+)
+
+// addTiersSheet lists every node of every application, grouped by tier.
+// Tiers without nodes get a single line with the node columns left empty.
+func addTiersSheet(f *excelize.File, appsdetails []appd.AppDetails) error {
+
+	var rows [][]interface{}
+
+	for _, app := range appsdetails {
+
+		for _, tier := range app.Tiers {
+
+			// Tier with no nodes
+			if len(tier.Nodes) == 0 {
+				rows = append(rows, []interface{}{app.Name, tier.Name, tier.Type, tier.NumberOfNodes, "", "", tier.AgentType, ""})
+				continue
+			}
+
+			for _, node := range tier.Nodes {
+				rows = append(rows, []interface{}{
+					app.Name,
+					tier.Name,
+					tier.Type,
+					tier.NumberOfNodes,
+					node.Name,
+					node.MachineName,
+					node.AgentType,
+					node.AppAgentVersion,
+				})
+			}
+
+		}
+
+	}
+
+	return newDetailSheet(f, TiersSheetName, "Tiers & Nodes", []tableColumn{
+		{"Application", 30},
+		{"Tier", 25},
+		{"Tier Type", 22},
+		{"Nodes in Tier", 15},
+		{"Node", 25},
+		{"Machine", 22},
+		{"Agent Type", 22},
+		{"Agent Version", 60},
+	}, rows)
+
+}
@@ -0,0 +1,52 @@
+package report
+
+import (
+	"math"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	TransactionsSheetName = "Business Transactions"
+)
+
+// addTransactionsSheet lists the business transactions of every
+// application, grouped by application and busiest first.
+func addTransactionsSheet(f *excelize.File, appsdetails []appd.AppDetails) error {
+
+	var rows [][]interface{}
+
+	for _, app := range appsdetails {
+
+		for _, bt := range app.BusinessTransactions {
+			rows = append(rows, []interface{}{
+				app.Name,
+				bt.TierName,
+				bt.Name,
+				bt.EntryPointType,
+				bt.Metrics.NumberOfCalls,
+				bt.Metrics.NumberOfErrors,
+				math.Round(bt.Metrics.AverageResponseTime*10) / 10,
+				math.Round(bt.Metrics.Percentile95ResponseTime*10) / 10,
+				bt.Metrics.NumberOfSlowCalls,
+				bt.Metrics.NumberOfVerySlowCalls,
+			})
+		}
+
+	}
+
+	return newDetailSheet(f, TransactionsSheetName, "Business Transactions", []tableColumn{
+		{"Application", 30},
+		{"Tier", 25},
+		{"Business Transaction", 35},
+		{"Entry Point", 22},
+		{"Number of Calls", 18},
+		{"Number of Errors", 18},
+		{"Avg Response Time (ms)", 18},
+		{"95th Percentile (ms)", 18},
+		{"Slow Calls", 14},
+		{"Very Slow Calls", 14},
+	}, rows)
+
+}
@@ -0,0 +1,59 @@
+package report
+
+import (
+	"math"
+	"time"
+
+	"github.com/sivanovie/appd-stats/pkg/appd"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	ViolationsSheetName = "Violations"
+)
+
+// addViolationsSheet lists the health rule violations of every application
+// in the report time range, grouped by application and oldest first.
+func addViolationsSheet(f *excelize.File, appsdetails []appd.AppDetails) error {
+
+	var rows [][]interface{}
+
+	for _, app := range appsdetails {
+
+		for _, violation := range app.Violations {
+
+			// Open violations have no end yet
+			end := "Open"
+			if !violation.End.IsZero() {
+				end = violation.End.Format(time.RFC3339)
+			}
+
+			rows = append(rows, []interface{}{
+				app.Name,
+				violation.RuleName,
+				violation.Severity,
+				violation.Status,
+				violation.EntityType,
+				violation.EntityName,
+				violation.Start.Format(time.RFC3339),
+				end,
+				math.Round(violation.Duration.Minutes()),
+			})
+
+		}
+
+	}
+
+	return newDetailSheet(f, ViolationsSheetName, "Health Rule Violations", []tableColumn{
+		{"Application", 30},
+		{"Health Rule", 55},
+		{"Severity", 12},
+		{"Status", 12},
+		{"Entity Type", 30},
+		{"Affected Entity", 30},
+		{"Start", 24},
+		{"End", 24},
+		{"Duration (min)", 15},
+	}, rows)
+
+}